@@ -0,0 +1,195 @@
+package main
+
+import (
+	"alloylinux/apm/src/nix"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Every file write and external command goes through here, so that
+// --dry-run can hold them back and show what would have happened
+type ChangeSet struct {
+	DryRun bool
+
+	// Content before apm first touched a file, nil for new files
+	originals map[string][]byte
+	// Content written so far, only kept in memory during a dry run
+	pending  map[string][]byte
+	removed  map[string]bool
+	order    []string
+	commands []string
+
+	// Open transaction, if any
+	tx *Transaction
+}
+
+var changes = newChangeSet()
+
+func newChangeSet() *ChangeSet {
+	return &ChangeSet{
+		originals: map[string][]byte{},
+		pending:   map[string][]byte{},
+		removed:   map[string]bool{},
+	}
+}
+
+// Read a file, seeing earlier writes of a dry run
+func (c *ChangeSet) ReadFile(path string) ([]byte, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if c.removed[abs] {
+		return nil, &fs.PathError{Op: "open", Path: path, Err: fs.ErrNotExist}
+	}
+	if data, ok := c.pending[abs]; ok {
+		return data, nil
+	}
+	return os.ReadFile(path)
+}
+
+// Write a file, or only remember the content during a dry run
+func (c *ChangeSet) WriteFile(path string, data []byte) error {
+	path, err := c.touch(path)
+	if err != nil {
+		return err
+	}
+	if c.DryRun {
+		c.pending[path] = data
+		delete(c.removed, path)
+		return nil
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// Delete a file, or only remember that during a dry run
+func (c *ChangeSet) Remove(path string) error {
+	path, err := c.touch(path)
+	if err != nil {
+		return err
+	}
+	if c.DryRun {
+		delete(c.pending, path)
+		c.removed[path] = true
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// Record a file's original content before its first change
+func (c *ChangeSet) touch(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if _, seen := c.originals[path]; seen {
+		return path, nil
+	}
+	old, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	if err := c.snapshot(path, old); err != nil {
+		return "", err
+	}
+	c.originals[path] = old
+	c.order = append(c.order, path)
+	return path, nil
+}
+
+// Create a directory, nothing to do during a dry run
+func (c *ChangeSet) MkdirAll(path string) error {
+	if c.DryRun {
+		return nil
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if err := c.recordDirs(path); err != nil {
+		return err
+	}
+	return os.MkdirAll(path, 0o755)
+}
+
+// Run an external command, or only print it during a dry run
+func (c *ChangeSet) Run(cmd *exec.Cmd) error {
+	line := strings.Join(cmd.Args, " ")
+	if cmd.Dir != "" {
+		line = fmt.Sprintf("(cd %s && %s)", cmd.Dir, line)
+	}
+	c.commands = append(c.commands, line)
+	if c.DryRun {
+		fmt.Printf("Would run: %s\n", line)
+		return nil
+	}
+	return cmd.Run()
+}
+
+// Files under dir with the suffix that only exist in a dry run
+func (c *ChangeSet) Created(dir, suffix string) []string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil
+	}
+	prefix := dir + string(filepath.Separator)
+	var created []string
+	for path := range c.pending {
+		if c.originals[path] == nil && strings.HasPrefix(path, prefix) && strings.HasSuffix(path, suffix) {
+			created = append(created, path)
+		}
+	}
+	sort.Strings(created)
+	return created
+}
+
+// Print a unified diff per changed file and the commands that would run
+func (c *ChangeSet) Report(out io.Writer) {
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Dry run, nothing was written.")
+	diffs := 0
+	for _, path := range c.order {
+		old := c.originals[path]
+		oldName := "a" + path
+		if old == nil {
+			oldName = "/dev/null"
+		}
+		newName := "b" + path
+		if c.removed[path] {
+			newName = "/dev/null"
+		}
+		diff := unifiedDiff(oldName, newName, old, c.pending[path])
+		if diff == "" {
+			continue
+		}
+		diffs++
+		fmt.Fprintln(out)
+		fmt.Fprint(out, diff)
+	}
+	if diffs == 0 {
+		fmt.Fprintln(out, "No files would be changed.")
+	}
+	if len(c.commands) > 0 {
+		fmt.Fprintln(out)
+		fmt.Fprintln(out, "Commands that would run:")
+		for _, line := range c.commands {
+			fmt.Fprintf(out, "  %s\n", line)
+		}
+	}
+}
+
+// Parse a .nix file as it currently stands
+func parseNixFile(path string) (*nix.File, error) {
+	src, err := changes.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return nix.Parse(src)
+}
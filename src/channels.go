@@ -0,0 +1,217 @@
+package main
+
+import (
+	cache "alloylinux/apm/src/database"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Input apm adds for --unstable
+const unstableChannel = "unstable"
+const unstableURL = "github:NixOS/nixpkgs/nixos-unstable"
+
+// Package channels from the flake's nixpkgs-like inputs, nixpkgs first,
+// pinned to the revisions in flake.lock where there is one
+func packageChannels(flakeDir string) []cache.Channel {
+	channels := []cache.Channel{{Name: cache.DefaultChannel, Ref: "nixpkgs"}}
+	flake, err := parseNixFile(filepath.Join(flakeDir, "flake.nix"))
+	if err == nil {
+		inputs, _, _ := flakeInputs(flake)
+		for _, in := range inputs {
+			if !isNixpkgsURL(in.URL) {
+				continue
+			}
+			if in.Name == cache.DefaultChannel {
+				channels[0].Ref = in.URL
+				continue
+			}
+			channels = append(channels, cache.Channel{Name: in.Name, Ref: in.URL})
+		}
+	}
+
+	lock, err := readFlakeLock(flakeDir)
+	if err != nil {
+		// Unlocked, nix resolves the refs itself
+		return channels
+	}
+	for i := range channels {
+		if locked, ok := lock.input(channels[i].Name); ok {
+			channels[i].Ref = locked.Ref
+			channels[i].Rev = locked.Rev
+		}
+	}
+	return channels
+}
+
+// Locked revision of a channel, empty when unknown
+func lockedRev(flakeDir, channel string) string {
+	ch, ok := findChannel(packageChannels(flakeDir), channel)
+	if !ok {
+		return ""
+	}
+	return ch.Rev
+}
+
+// Warn when a channel's cache is older than the configured age, or was
+// built from another revision than the flake.lock pins
+func warnIfCacheStale(flakeDir, channel string) {
+	info, err := cache.ReadInfo(channel)
+	if err != nil {
+		// Missing caches are reported where they are used
+		return
+	}
+	if info.BuiltAt.IsZero() {
+		fmt.Printf("Warning: the %s cache has no build information; run 'apm makecache --channel %s'\n", channel, channel)
+		return
+	}
+	if maxAge := cacheMaxAge(); maxAge > 0 && time.Since(info.BuiltAt) > maxAge {
+		fmt.Printf("Warning: the %s cache is %s old; run 'apm makecache --channel %s'\n", channel, formatAge(time.Since(info.BuiltAt)), channel)
+	}
+
+	rev := lockedRev(flakeDir, channel)
+	if rev == "" || info.Rev == rev {
+		return
+	}
+	built := "an unpinned revision"
+	if info.Rev != "" {
+		built = shortRev(info.Rev)
+	}
+	fmt.Printf("Warning: the %s cache was built from %s but flake.lock pins %s; run 'apm makecache --channel %s'\n", channel, built, shortRev(rev), channel)
+}
+
+// Caches older than this get a warning
+const defaultCacheMaxAge = 14 * 24 * time.Hour
+
+// Configured maximum cache age, 0 when the check is off
+func cacheMaxAge() time.Duration {
+	age, err := parseAge(settings.CacheMaxAge)
+	if err != nil {
+		return defaultCacheMaxAge
+	}
+	return age
+}
+
+// Where makecache downloads prebuilt caches from, empty to build locally
+func cacheSource() string {
+	return settings.CacheSource
+}
+
+// Download a channel's cache, warning when it doesn't match flake.lock
+func downloadCache(ch cache.Channel, source string, opts cache.Options) error {
+	m, err := cache.Download(ch, source, opts)
+	if err != nil {
+		return err
+	}
+	if ch.Rev != "" && m.Rev != ch.Rev {
+		fmt.Printf("Warning: the downloaded %s cache is for %s but flake.lock pins %s; run 'apm makecache --build --channel %s' for an exact match\n", ch.Name, shortRev(m.Rev), shortRev(ch.Rev), ch.Name)
+	}
+	return nil
+}
+
+// Parse an age like 14d, 36h or off
+func parseAge(s string) (time.Duration, error) {
+	switch s {
+	case "0", "off":
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age '%s'", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age '%s' (use e.g. 14d, 36h or off)", s)
+	}
+	return d, nil
+}
+
+// Rough age for messages
+func formatAge(d time.Duration) string {
+	switch {
+	case d >= 48*time.Hour:
+		return fmt.Sprintf("%d days", int(d.Hours()/24))
+	case d >= 2*time.Hour:
+		return fmt.Sprintf("%d hours", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%d minutes", int(d.Minutes()))
+	}
+}
+
+func shortRev(rev string) string {
+	if len(rev) > 12 {
+		return rev[:12]
+	}
+	return rev
+}
+
+// Look up a channel by name; unstable works before its input is added
+func findChannel(channels []cache.Channel, name string) (cache.Channel, bool) {
+	for _, ch := range channels {
+		if ch.Name == name {
+			return ch, true
+		}
+	}
+	if name == unstableChannel {
+		return cache.Channel{Name: unstableChannel, Ref: unstableURL}, true
+	}
+	return cache.Channel{}, false
+}
+
+// Channel packages are installed from
+func installChannel(unstable bool) string {
+	if unstable {
+		return unstableChannel
+	}
+	return cache.DefaultChannel
+}
+
+// Whether a flake URL points at nixpkgs
+func isNixpkgsURL(url string) bool {
+	lower := strings.ToLower(url)
+	return strings.Contains(lower, "nixos/nixpkgs") ||
+		strings.HasPrefix(lower, "nixpkgs") ||
+		strings.HasPrefix(lower, "flake:nixpkgs") ||
+		strings.Contains(lower, "channels.nixos.org")
+}
+
+// Print one cache's metadata for apm cache status
+func printCacheInfo(info *cache.Info, channels []cache.Channel, maxAge time.Duration) {
+	fmt.Printf("%s\n", info.Channel)
+	fmt.Printf("  Path:     %s (%.1f MB)\n", info.Path, float64(info.Size)/(1<<20))
+	if info.BuiltAt.IsZero() {
+		fmt.Println("  No build information, rebuild with 'apm makecache'")
+		return
+	}
+	age := time.Since(info.BuiltAt)
+	stale := ""
+	if maxAge > 0 && age > maxAge {
+		stale = " (stale)"
+	}
+	fmt.Printf("  Built:    %s, %s ago%s\n", info.BuiltAt.Local().Format("2006-01-02 15:04"), formatAge(age), stale)
+	fmt.Printf("  Source:   %s\n", info.Ref)
+	rev := info.Rev
+	if rev == "" {
+		rev = "unpinned"
+	}
+	if ch, ok := findChannel(channels, info.Channel); ok && ch.Rev != "" {
+		if ch.Rev == info.Rev {
+			rev += " (matches flake.lock)"
+		} else {
+			rev += fmt.Sprintf(" (flake.lock pins %s)", shortRev(ch.Rev))
+		}
+	}
+	fmt.Printf("  Revision: %s\n", rev)
+	fmt.Printf("  System:   %s\n", info.System)
+	fmt.Printf("  Packages: %d\n", info.Count)
+	schema := fmt.Sprintf("%d", info.SchemaVersion)
+	if info.SchemaVersion != cache.SchemaVersion {
+		schema += fmt.Sprintf(" (apm expects %d, rebuild with 'apm makecache')", cache.SchemaVersion)
+	}
+	fmt.Printf("  Schema:   %s\n", schema)
+}
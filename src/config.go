@@ -0,0 +1,397 @@
+package main
+
+import (
+	cache "alloylinux/apm/src/database"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// apm settings, kept in ~/.config/apm/config.json
+type Config struct {
+	// Flake directory holding the system configuration
+	Flake string `json:"flake"`
+	// Installation method when no flag picks one
+	Method string `json:"method"`
+	// Channel packages are installed from when --unstable isn't given
+	Channel string `json:"channel"`
+	// Package file per method, relative to the flake; without one apm uses
+	// the only file with the method's list, or asks which to use
+	Files map[string]string `json:"files,omitempty"`
+	// Command put in front of nixos-rebuild and nix flake update, empty for none
+	Sudo string `json:"sudo"`
+	// How prompts are answered when no flag says: ask, yes, no or default
+	Prompt string `json:"prompt"`
+	// Commit every change to the flake's git repository
+	GitAutoCommit bool `json:"git_autocommit"`
+	// Warn about caches older than this, off to never warn
+	CacheMaxAge string `json:"cache_max_age"`
+	// Where makecache downloads prebuilt caches from, empty to build them
+	CacheSource string `json:"cache_source"`
+	// Profile used without --profile or APM_PROFILE, empty for the flake above
+	Profile string `json:"profile,omitempty"`
+	// Other flakes by name, picked with --profile, APM_PROFILE or apm profile use
+	Profiles map[string]Profile `json:"profiles,omitempty"`
+}
+
+// Settings of this run, loaded in main
+var settings = defaultConfig()
+
+func defaultConfig() *Config {
+	return &Config{
+		Flake:       "/etc/nixos/",
+		Method:      methodFlagName(HomeManager),
+		Channel:     cache.DefaultChannel,
+		Sudo:        "sudo",
+		Prompt:      "ask",
+		CacheMaxAge: "14d",
+	}
+}
+
+func configDir() (string, error) {
+	homedir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homedir, ".config", "apm"), nil
+}
+
+func configPath() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "config.json"), nil
+}
+
+// Read the config file, creating it on first run from the defaults and
+// whatever older apm versions kept in separate text files
+func loadConfig() (*Config, error) {
+	path, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+	c := defaultConfig()
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, c); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", path, err)
+		}
+		return c, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	migrated, err := migrateLegacySettings(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.save(); err != nil {
+		return nil, fmt.Errorf("error creating %s: %v", path, err)
+	}
+	for _, file := range migrated {
+		os.Remove(file)
+	}
+	if len(migrated) > 0 {
+		fmt.Printf("Moved settings from %d old file(s) into %s\n", len(migrated), path)
+	}
+	return c, nil
+}
+
+// Settings files of apm versions before config.json
+var legacySettings = []struct {
+	file string
+	key  string
+}{
+	{"flakelocation.txt", "flake"},
+	{"gitautocommit.txt", "git_autocommit"},
+	{"cachemaxage.txt", "cache_max_age"},
+	{"cachesource.txt", "cache_source"},
+}
+
+// Copy the old text files into c, returning the ones that were read
+func migrateLegacySettings(c *Config) ([]string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return nil, err
+	}
+	var migrated []string
+	for _, legacy := range legacySettings {
+		path := filepath.Join(dir, legacy.file)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		value := strings.TrimSpace(string(data))
+		if err := setConfigKey(c, legacy.key, value); err != nil {
+			fmt.Printf("Warning: ignoring %s: %v\n", path, err)
+		}
+		migrated = append(migrated, path)
+	}
+	return migrated, nil
+}
+
+// Write the config file, replacing the old one in one step
+func (c *Config) save() error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Setting as shown by apm config
+type configKey struct {
+	Name string
+	Help string
+	Get  func(c *Config) string
+	Set  func(c *Config, value string) error
+}
+
+var configKeys = []configKey{
+	{
+		Name: "flake",
+		Help: "Flake directory with your configuration, optionally with #host",
+		Get:  func(c *Config) string { return c.Flake },
+		Set: func(c *Config, value string) error {
+			if value == "" {
+				return errors.New("the flake location can't be empty")
+			}
+			c.Flake = value
+			return nil
+		},
+	},
+	{
+		Name: "profile",
+		Help: "Profile used without --profile or APM_PROFILE; default for the flake above",
+		Get: func(c *Config) string {
+			if c.Profile == "" {
+				return defaultProfile
+			}
+			return c.Profile
+		},
+		Set: func(c *Config, value string) error {
+			if value == defaultProfile || value == "" {
+				c.Profile = ""
+				return nil
+			}
+			if _, ok := c.Profiles[value]; !ok {
+				return fmt.Errorf("no profile named '%s'; add it with 'apm profile add'", value)
+			}
+			c.Profile = value
+			return nil
+		},
+	},
+	{
+		Name: "method",
+		Help: "Default installation method: home-manager, nix-env or flatpak",
+		Get:  func(c *Config) string { return c.Method },
+		Set: func(c *Config, value string) error {
+			if _, err := ParseMethod(value); err != nil {
+				return err
+			}
+			c.Method = value
+			return nil
+		},
+	},
+	{
+		Name: "channel",
+		Help: "Channel to install from: nixpkgs or unstable",
+		Get:  func(c *Config) string { return c.Channel },
+		Set: func(c *Config, value string) error {
+			if value != cache.DefaultChannel && value != unstableChannel {
+				return fmt.Errorf("expected '%s' or '%s', got '%s'", cache.DefaultChannel, unstableChannel, value)
+			}
+			c.Channel = value
+			return nil
+		},
+	},
+	filesKey(NixEnv),
+	filesKey(HomeManager),
+	filesKey(Flatpak),
+	{
+		Name: "sudo",
+		Help: "Command that runs nixos-rebuild and nix flake update as root, e.g. sudo, doas or none",
+		Get:  func(c *Config) string { return c.Sudo },
+		Set: func(c *Config, value string) error {
+			if value == "none" {
+				value = ""
+			}
+			c.Sudo = value
+			return nil
+		},
+	},
+	{
+		Name: "prompt",
+		Help: "How prompts are answered without --yes, --no or --assume-default: ask, yes, no or default",
+		Get:  func(c *Config) string { return c.Prompt },
+		Set: func(c *Config, value string) error {
+			if _, err := parsePromptSetting(value); err != nil {
+				return err
+			}
+			c.Prompt = value
+			return nil
+		},
+	},
+	{
+		Name: "git_autocommit",
+		Help: "Commit every apm change to the flake's git repository: on or off",
+		Get: func(c *Config) string {
+			if c.GitAutoCommit {
+				return "on"
+			}
+			return "off"
+		},
+		Set: func(c *Config, value string) error {
+			if value != "on" && value != "off" {
+				return fmt.Errorf("expected 'on' or 'off', got '%s'", value)
+			}
+			c.GitAutoCommit = value == "on"
+			return nil
+		},
+	},
+	{
+		Name: "cache_max_age",
+		Help: "Warn about package caches older than this, e.g. 14d, 36h or off",
+		Get:  func(c *Config) string { return c.CacheMaxAge },
+		Set: func(c *Config, value string) error {
+			if _, err := parseAge(value); err != nil {
+				return err
+			}
+			c.CacheMaxAge = value
+			return nil
+		},
+	},
+	{
+		Name: "cache_source",
+		Help: "URL makecache downloads prebuilt caches from, or off to build them",
+		Get:  func(c *Config) string { return c.CacheSource },
+		Set: func(c *Config, value string) error {
+			if value == "off" || value == "" {
+				c.CacheSource = ""
+				return nil
+			}
+			if !strings.HasPrefix(value, "http://") && !strings.HasPrefix(value, "https://") {
+				return fmt.Errorf("expected an http(s) URL or 'off', got '%s'", value)
+			}
+			c.CacheSource = value
+			return nil
+		},
+	},
+}
+
+// files.<method>: the package file of one installation method
+func filesKey(method InstallationMethod) configKey {
+	name := methodFlagName(method)
+	return configKey{
+		Name: "files." + name,
+		Help: fmt.Sprintf("Package file add uses for %s, relative to the flake (empty: the only file with the list, or ask)", name),
+		Get:  func(c *Config) string { return c.Files[name] },
+		Set: func(c *Config, value string) error {
+			if value == "" {
+				delete(c.Files, name)
+				return nil
+			}
+			if filepath.IsAbs(value) || !strings.HasSuffix(value, ".nix") {
+				return fmt.Errorf("expected a .nix file relative to the flake, got '%s'", value)
+			}
+			if c.Files == nil {
+				c.Files = map[string]string{}
+			}
+			c.Files[name] = filepath.Clean(value)
+			return nil
+		},
+	}
+}
+
+func findConfigKey(name string) (configKey, error) {
+	for _, k := range configKeys {
+		if k.Name == name {
+			return k, nil
+		}
+	}
+	return configKey{}, fmt.Errorf("unknown setting '%s' (see 'apm config list')", name)
+}
+
+func getConfigKey(c *Config, name string) (string, error) {
+	k, err := findConfigKey(name)
+	if err != nil {
+		return "", err
+	}
+	return k.Get(c), nil
+}
+
+func setConfigKey(c *Config, name, value string) error {
+	k, err := findConfigKey(name)
+	if err != nil {
+		return err
+	}
+	return k.Set(c, value)
+}
+
+// Change one setting and save the config file
+func setConfigValue(name, value string) error {
+	if err := setConfigKey(settings, name, value); err != nil {
+		return err
+	}
+	return settings.save()
+}
+
+// No flake location in the settings of the active profile
+var errNoFlake = errors.New("no flake location set; use 'apm set-flake-location <dir>'")
+
+// Flake directory of the active profile
+func configuredFlakeDir() (string, error) {
+	if err := checkProfile(); err != nil {
+		return "", err
+	}
+	dir, _ := splitFlakeRef(profileFlake())
+	if dir == "" {
+		return "", errNoFlake
+	}
+	return dir, nil
+}
+
+// Installation method named in the config file
+func defaultMethod() InstallationMethod {
+	method, err := ParseMethod(settings.Method)
+	if err != nil {
+		return HomeManager
+	}
+	return method
+}
+
+// Package file the config file names for a method, empty when none
+func configuredPackageFile(flakeDir string, method InstallationMethod) string {
+	file := settings.Files[methodFlagName(method)]
+	if file == "" {
+		return ""
+	}
+	return filepath.Join(flakeDir, file)
+}
+
+// Command run as root through the configured sudo command
+func privileged(name string, args ...string) *exec.Cmd {
+	prefix := strings.Fields(settings.Sudo)
+	if len(prefix) == 0 {
+		return exec.Command(name, args...)
+	}
+	return exec.Command(prefix[0], append(append(prefix[1:], name), args...)...)
+}
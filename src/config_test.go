@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLegacySettingsMigration(t *testing.T) {
+	home := testEnv(t)
+	dir := filepath.Join(home, ".config", "apm")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(dir, "flakelocation.txt"), "/home/me/nix-config\n")
+	writeTestFile(t, filepath.Join(dir, "gitautocommit.txt"), "on")
+	// Bad values are dropped with a warning, the file still goes
+	writeTestFile(t, filepath.Join(dir, "cachemaxage.txt"), "soon")
+
+	c, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(c *Config) {
+		t.Helper()
+		if c.Flake != "/home/me/nix-config" {
+			t.Errorf("flake = %q", c.Flake)
+		}
+		if !c.GitAutoCommit {
+			t.Error("git_autocommit not migrated")
+		}
+		if c.CacheMaxAge != "14d" {
+			t.Errorf("cache_max_age = %q, want the default", c.CacheMaxAge)
+		}
+		if c.Method != methodFlagName(HomeManager) {
+			t.Errorf("method = %q, want the default", c.Method)
+		}
+	}
+	check(c)
+	for _, name := range []string{"flakelocation.txt", "gitautocommit.txt", "cachemaxage.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed", name)
+		}
+	}
+
+	// Later runs read config.json, and old files showing up again are
+	// left alone
+	writeTestFile(t, filepath.Join(dir, "flakelocation.txt"), "/etc/nixos")
+	c, err = loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(c)
+	if _, err := os.Stat(filepath.Join(dir, "flakelocation.txt")); err != nil {
+		t.Errorf("flakelocation.txt was touched once config.json existed: %v", err)
+	}
+}
+
+func TestLoadConfigWithoutLegacyFiles(t *testing.T) {
+	home := testEnv(t)
+	c, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c, defaultConfig()) {
+		t.Errorf("got %+v, want the defaults", c)
+	}
+	if _, err := os.Stat(filepath.Join(home, ".config", "apm", "config.json")); err != nil {
+		t.Errorf("config.json not created: %v", err)
+	}
+}
@@ -1,102 +1,355 @@
 package cache
 
 import (
-	"context"
+	"bytes"
+	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
-
-	"github.com/glebarez/sqlite"
-	"gorm.io/gorm"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
-type PackageInfo struct {
-	Description string `json:"description"`
-	Pname       string `json:"pname"`
-	Version     string `json:"version"`
+// Rows per INSERT statement. Binding gets slower with every parameter
+// in the statement, and each row has 13 of them.
+const insertBatchSize = 50
+
+type Options struct {
+	// No progress output, only errors
+	Quiet bool
 }
 
-func MakeCache() {
-	RemoveCache()
-	ctx := context.Background()
+// Build a channel's package cache from `nix-env -qa`, replacing the old
+// one only once the new one is complete
+func MakeCache(ch Channel, opts Options) error {
+	apmDir, err := Dir()
+	if err != nil {
+		return fmt.Errorf("error getting user home directory: %v", err)
+	}
+	dbPath, err := DBPath(ch.Name)
+	if err != nil {
+		return err
+	}
 
-	// Get JSON from nix
-	output, err := exec.Command("nix", "search", "nixpkgs", "", "--json").Output()
+	// Ensure cache directory
+	if err := os.MkdirAll(apmDir, 0o755); err != nil {
+		return fmt.Errorf("error creating apm cache directory: %v", err)
+	}
+
+	// Build next to the old cache, which stays usable until the swap
+	tmp, err := os.CreateTemp(apmDir, "apm-*.db.tmp")
 	if err != nil {
-		fmt.Printf("Error running nix search: %v\n", err)
-		return
+		return fmt.Errorf("error creating temporary database: %v", err)
 	}
+	tmpPath := tmp.Name()
+	tmp.Close()
 
-	// Parse JSON
-	var rawPackages map[string]PackageInfo
-	err = json.Unmarshal(output, &rawPackages)
+	if !opts.Quiet {
+		fmt.Printf("Building cache for %s (%s)\n", ch.Name, ch.Ref)
+	}
+	count, err := writeCache(tmpPath, ch, opts)
 	if err != nil {
-		fmt.Printf("Error parsing JSON: %v\n", err)
-		return
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, dbPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error installing cache: %v", err)
 	}
+	if !opts.Quiet {
+		fmt.Printf("Cached %d packages in %s\n", count, dbPath)
+	}
+	return nil
+}
 
-	var packages []PackageInfo
-	for _, pkg := range rawPackages {
-		packages = append(packages, pkg)
+// Create a complete cache database at path, returning the package count
+func writeCache(path string, ch Channel, opts Options) (int, error) {
+	db, err := openFile(path)
+	if err != nil {
+		return 0, err
 	}
+	defer db.Close()
 
-	fmt.Println("Found packages:")
+	// The file is thrown away on failure, so skip the journal
+	stmts := append([]string{"PRAGMA journal_mode = OFF", "PRAGMA synchronous = OFF"}, createTables...)
+	for _, stmt := range stmts {
+		if err := db.Exec(stmt).Error; err != nil {
+			return 0, err
+		}
+	}
 
-	homedir, err := os.UserHomeDir()
-	apmDir := homedir + "/.cache/apm"
-	dbPath := apmDir + "/apm.db"
+	w, err := newBatchWriter(db.sqlDB)
+	if err != nil {
+		return 0, err
+	}
+	defer w.Abort()
 
-	// Ensure cache directory
-	if err := os.MkdirAll(apmDir, 0o755); err != nil {
-		fmt.Printf("Error creating apm cache directory: %v\n", err)
-		return
+	progress := newProgress(opts.Quiet)
+	var system string
+	err = streamPackages(ch.Ref, func(pkg PackageInfo, pkgSystem string) error {
+		if err := w.Add(pkg); err != nil {
+			return err
+		}
+		system = pkgSystem
+		progress.Tick()
+		return nil
+	})
+	progress.Done()
+	if err != nil {
+		return 0, err
+	}
+	if err := w.Commit(); err != nil {
+		return 0, err
 	}
 
-	db, err := gorm.Open(sqlite.Open(dbPath), &gorm.Config{})
+	// Indexes are cheaper to build once the rows are in
+	if !opts.Quiet {
+		fmt.Println("Building indexes...")
+	}
+	if err := migrate(db.DB, 0); err != nil {
+		return 0, fmt.Errorf("error creating indexes: %v", err)
+	}
+	// Remember the source, so a changed flake.lock or an old cache can be noticed
+	meta := map[string]string{
+		MetaBuiltAt: time.Now().UTC().Format(time.RFC3339),
+		MetaRev:     ch.Rev,
+		MetaRef:     ch.Ref,
+		MetaSystem:  system,
+		MetaCount:   strconv.Itoa(progress.count),
+	}
+	if err := writeMeta(db.DB, meta); err != nil {
+		return 0, fmt.Errorf("error writing cache metadata: %v", err)
+	}
+	return progress.count, nil
+}
+
+// Environment for listing every package, whatever its license or state;
+// the flags are recorded in the cache instead
+var queryEnv = []string{
+	"NIXPKGS_ALLOW_UNFREE=1",
+	"NIXPKGS_ALLOW_BROKEN=1",
+	"NIXPKGS_ALLOW_INSECURE=1",
+	"NIXPKGS_ALLOW_UNSUPPORTED_SYSTEM=1",
+}
+
+// Fetch the flake's source and run `nix-env -qaP --json --meta` on it,
+// decoding its JSON object one package at a time
+func streamPackages(ref string, each func(pkg PackageInfo, system string) error) error {
+	src, err := prefetch(ref)
 	if err != nil {
-		fmt.Printf("Error connecting to database: %v\n", err)
-		return
+		return err
+	}
+	// Ignore the user's nixpkgs config and overlays, the cache describes nixpkgs itself
+	cmd := exec.Command("nix-env", "-f", src, "-qaP", "--json", "--meta",
+		"--arg", "config", "{}", "--arg", "overlays", "[]")
+	cmd.Env = append(os.Environ(), queryEnv...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("error running nix-env: %v", err)
+	}
+
+	var writeErr error
+	err = decodePackages(stdout, func(pkg PackageInfo, system string) error {
+		writeErr = each(pkg, system)
+		return writeErr
+	})
+	if writeErr != nil {
+		// Stop nix instead of waiting for output nobody reads
+		cmd.Process.Kill()
+		cmd.Wait()
+		return writeErr
+	}
+	if err != nil {
+		// Bad JSON usually means nix failed, let it finish and say why
+		io.Copy(io.Discard, stdout)
 	}
+	if waitErr := cmd.Wait(); waitErr != nil {
+		return commandError("nix-env", waitErr, stderr.String())
+	}
+	return err
+}
 
-	db.AutoMigrate(&PackageInfo{})
+// Store path of a flake reference's source
+func prefetch(ref string) (string, error) {
+	cmd := exec.Command("nix", "flake", "prefetch", "--json", ref)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", commandError("nix flake prefetch", err, stderr.String())
+	}
+	var result struct {
+		StorePath string `json:"storePath"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil || result.StorePath == "" {
+		return "", fmt.Errorf("error fetching %s: unexpected nix flake prefetch output", ref)
+	}
+	return result.StorePath, nil
+}
 
-	// Collect errors
-	var errs []error
+// Error of a failed command, with what it printed
+func commandError(name string, err error, stderr string) error {
+	msg := strings.TrimSpace(stderr)
+	if msg == "" {
+		return fmt.Errorf("error running %s: %v", name, err)
+	}
+	return fmt.Errorf("error running %s: %v\n%s", name, err, msg)
+}
+
+// Decode {"<attr path>": {...}, ...} without holding the whole object
+func decodePackages(r io.Reader, each func(pkg PackageInfo, system string) error) error {
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("error parsing JSON: %v", err)
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return fmt.Errorf("error parsing JSON: expected an object")
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("error parsing JSON: %v", err)
+		}
+		attrPath, _ := tok.(string)
+		var entry envPackage
+		if err := dec.Decode(&entry); err != nil {
+			return fmt.Errorf("error parsing JSON for %s: %v", attrPath, err)
+		}
+		pkg := entry.info()
+		pkg.AttrPath = attrPath
+		pkg.PackageSet = packageSetOf(attrPath)
+		if err := each(pkg, entry.System); err != nil {
+			return err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return fmt.Errorf("error parsing JSON: %v", err)
+	}
+	return nil
+}
 
-	for i, pkg := range packages {
-		fmt.Printf("%3d. %s (v%s)\n    %s\n", i+1, pkg.Pname, pkg.Version, pkg.Description)
+// Columns written for each package, in the order of batchWriter.flush
+const (
+	insertColumns = "description, pname, version, attr_path, package_set, " +
+		"license, homepage, platforms, main_program, long_description, unfree, broken, insecure"
+	insertRow = "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?), "
+)
 
-		err = db.WithContext(ctx).Create(&PackageInfo{
-			Pname:       pkg.Pname,
-			Version:     pkg.Version,
-			Description: pkg.Description,
-		}).Error
+// Inserts packages inside one transaction, a batch per statement
+type batchWriter struct {
+	tx       *sql.Tx
+	prepared map[int]*sql.Stmt
+	batch    []PackageInfo
+	written  int
+}
 
+func newBatchWriter(sqlDB *sql.DB) (*batchWriter, error) {
+	tx, err := sqlDB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &batchWriter{tx: tx, prepared: map[int]*sql.Stmt{}}, nil
+}
+
+func (w *batchWriter) Add(pkg PackageInfo) error {
+	w.batch = append(w.batch, pkg)
+	if len(w.batch) < insertBatchSize {
+		return nil
+	}
+	return w.flush()
+}
+
+func (w *batchWriter) flush() error {
+	if len(w.batch) == 0 {
+		return nil
+	}
+	// One statement for full batches, another for the remainder
+	stmt, ok := w.prepared[len(w.batch)]
+	if !ok {
+		rows := strings.TrimSuffix(strings.Repeat(insertRow, len(w.batch)), ", ")
+		var err error
+		stmt, err = w.tx.Prepare("INSERT INTO package_infos (" + insertColumns + ") VALUES " + rows)
 		if err != nil {
-			fmt.Printf("Error inserting package %s: %v\n", pkg.Pname, err)
-			errs = append(errs, err)
+			return err
 		}
+		w.prepared[len(w.batch)] = stmt
 	}
 
-	for i, err := range errs {
-		fmt.Printf("Error %d: %v\n", i+1, err)
+	args := make([]any, 0, len(w.batch)*13)
+	for _, pkg := range w.batch {
+		args = append(args, pkg.Description, pkg.Pname, pkg.Version, pkg.AttrPath, pkg.PackageSet,
+			pkg.License, pkg.Homepage, pkg.Platforms, pkg.MainProgram, pkg.LongDescription,
+			pkg.Unfree, pkg.Broken, pkg.Insecure)
+	}
+	if _, err := stmt.Exec(args...); err != nil {
+		return fmt.Errorf("error inserting packages %d-%d: %v", w.written+1, w.written+len(w.batch), err)
 	}
+	w.written += len(w.batch)
+	w.batch = w.batch[:0]
+	return nil
 }
 
+// Write the last batch and commit
+func (w *batchWriter) Commit() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	w.closeStmts()
+	return w.tx.Commit()
+}
+
+// Roll back unless committed
+func (w *batchWriter) Abort() {
+	w.closeStmts()
+	w.tx.Rollback()
+}
+
+func (w *batchWriter) closeStmts() {
+	for n, stmt := range w.prepared {
+		stmt.Close()
+		delete(w.prepared, n)
+	}
+}
+
+// Parent set of an attribute path
+func packageSetOf(attrPath string) string {
+	if i := strings.LastIndex(attrPath, "."); i != -1 {
+		return attrPath[:i]
+	}
+	return ""
+}
+
+// Remove the cache databases of every channel
 func RemoveCache() {
-	homedir, err := os.UserHomeDir()
+	dir, err := Dir()
 	if err != nil {
 		fmt.Printf("Error getting user home directory: %v\n", err)
 		return
 	}
-	cacheFile := homedir + "/.cache/apm/apm.db"
-	if err := os.Remove(cacheFile); err != nil {
-		if os.IsNotExist(err) {
-			fmt.Println("Cache file does not exist.")
-		} else {
-			fmt.Printf("Error removing cache file: %v\n", err)
+	files, _ := filepath.Glob(filepath.Join(dir, "apm-*.db"))
+	files = append([]string{filepath.Join(dir, "apm.db")}, files...)
+	removed := 0
+	for _, cacheFile := range files {
+		if err := os.Remove(cacheFile); err != nil {
+			if !os.IsNotExist(err) {
+				fmt.Printf("Error removing cache file: %v\n", err)
+			}
+			continue
 		}
+		removed++
+	}
+	if removed == 0 {
+		fmt.Println("Cache file does not exist.")
 	} else {
 		fmt.Println("Cache file removed successfully.")
 	}
@@ -0,0 +1,63 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Channel the main nixpkgs input is cached under
+const DefaultChannel = "nixpkgs"
+
+// Package source with its own cache database
+type Channel struct {
+	// Flake input name, e.g. nixpkgs or unstable
+	Name string
+	// Flake reference the packages are read from
+	Ref string
+	// Locked revision, empty when the input is not locked
+	Rev string
+}
+
+// Directory holding the cache databases
+func Dir() (string, error) {
+	homedir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homedir, ".cache", "apm"), nil
+}
+
+// Database file for a channel: apm.db for nixpkgs, apm-<name>.db otherwise
+func DBPath(channel string) (string, error) {
+	if channel == "" || strings.ContainsAny(channel, `/\`) {
+		return "", fmt.Errorf("invalid channel name '%s'", channel)
+	}
+	dir, err := Dir()
+	if err != nil {
+		return "", err
+	}
+	if channel == DefaultChannel {
+		return filepath.Join(dir, "apm.db"), nil
+	}
+	return filepath.Join(dir, "apm-"+channel+".db"), nil
+}
+
+// Error for a channel without a cache yet, matching ErrNoCache
+func MissingCacheError(channel string) error {
+	return missingCacheError(channel)
+}
+
+type missingCacheError string
+
+func (e missingCacheError) Error() string {
+	if e == DefaultChannel {
+		return "no local database found! Generate it with 'apm makecache'"
+	}
+	return fmt.Sprintf("no local database for channel '%s'! Generate it with 'apm makecache --channel %s'", string(e), string(e))
+}
+
+func (e missingCacheError) Is(target error) bool {
+	return target == ErrNoCache
+}
@@ -0,0 +1,296 @@
+package cache
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sidecar describing a published cache database
+type Manifest struct {
+	Channel string `json:"channel"`
+	// Compressed database, relative to the manifest
+	File string `json:"file"`
+	// sha256 of the compressed file
+	SHA256        string `json:"sha256"`
+	Size          int64  `json:"size"`
+	Rev           string `json:"rev"`
+	Ref           string `json:"ref"`
+	System        string `json:"system"`
+	Count         int    `json:"count"`
+	SchemaVersion int    `json:"schema_version"`
+	BuiltAt       string `json:"built_at"`
+}
+
+// Published file names of a channel's cache
+func publishedNames(channel string) (db, manifest string) {
+	base := "apm"
+	if channel != DefaultChannel {
+		base += "-" + channel
+	}
+	return base + ".db.gz", base + ".json"
+}
+
+// Manifest URL for a channel: the source itself when it names a .json
+// file, otherwise the channel's manifest inside the source directory
+func ManifestURL(source, channel string) string {
+	if strings.HasSuffix(source, ".json") {
+		return source
+	}
+	_, manifest := publishedNames(channel)
+	return strings.TrimSuffix(source, "/") + "/" + manifest
+}
+
+// Download a prebuilt cache for a channel, verify it and swap it in
+func Download(ch Channel, source string, opts Options) (*Manifest, error) {
+	apmDir, err := Dir()
+	if err != nil {
+		return nil, fmt.Errorf("error getting user home directory: %v", err)
+	}
+	dbPath, err := DBPath(ch.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(apmDir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating apm cache directory: %v", err)
+	}
+
+	manifestURL := ManifestURL(source, ch.Name)
+	m, err := fetchManifest(manifestURL)
+	if err != nil {
+		return nil, err
+	}
+	if m.Channel != "" && m.Channel != ch.Name {
+		return nil, fmt.Errorf("%s is a cache for '%s', not '%s'", manifestURL, m.Channel, ch.Name)
+	}
+	if m.SchemaVersion > SchemaVersion {
+		return nil, fmt.Errorf("%s needs a newer apm (schema version %d, this apm has %d)", manifestURL, m.SchemaVersion, SchemaVersion)
+	}
+	dbURL, err := resolveURL(manifestURL, m.File)
+	if err != nil {
+		return nil, fmt.Errorf("bad file in manifest: %v", err)
+	}
+
+	if !opts.Quiet {
+		fmt.Printf("Downloading cache for %s from %s\n", ch.Name, dbURL)
+	}
+	gz, err := os.CreateTemp(apmDir, "apm-*.db.gz.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary file: %v", err)
+	}
+	defer os.Remove(gz.Name())
+	defer gz.Close()
+	sum, size, err := fetchFile(dbURL, gz)
+	if err != nil {
+		return nil, err
+	}
+	if m.Size > 0 && size != m.Size {
+		return nil, fmt.Errorf("download of %s is %d bytes, manifest says %d", dbURL, size, m.Size)
+	}
+	if !strings.EqualFold(sum, m.SHA256) {
+		return nil, fmt.Errorf("checksum mismatch for %s: got %s, manifest says %s", dbURL, sum, m.SHA256)
+	}
+
+	tmp, err := os.CreateTemp(apmDir, "apm-*.db.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary database: %v", err)
+	}
+	tmpPath := tmp.Name()
+	err = gunzipTo(gz, tmp)
+	tmp.Close()
+	if err == nil {
+		err = checkDownloaded(tmpPath, m)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, dbPath); err != nil {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("error installing cache: %v", err)
+	}
+	if !opts.Quiet {
+		fmt.Printf("Installed %d packages (%s) in %s\n", m.Count, m.Rev, dbPath)
+	}
+	return m, nil
+}
+
+func fetchManifest(manifestURL string) (*Manifest, error) {
+	resp, err := httpGet(manifestURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var m Manifest
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return nil, fmt.Errorf("error parsing manifest %s: %v", manifestURL, err)
+	}
+	if m.File == "" || m.SHA256 == "" {
+		return nil, fmt.Errorf("manifest %s lacks a file or checksum", manifestURL)
+	}
+	return &m, nil
+}
+
+// Download into w, returning the sha256 and size of what was written
+func fetchFile(fileURL string, w io.Writer) (string, int64, error) {
+	resp, err := httpGet(fileURL)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(w, h), resp.Body)
+	if err != nil {
+		return "", 0, fmt.Errorf("error downloading %s: %v", fileURL, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+func httpGet(rawURL string) (*http.Response, error) {
+	client := &http.Client{Timeout: 30 * time.Minute}
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading %s: %v", rawURL, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("error downloading %s: %s", rawURL, resp.Status)
+	}
+	return resp, nil
+}
+
+// Resolve the manifest's file name against the manifest URL
+func resolveURL(base, ref string) (string, error) {
+	b, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	r, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	return b.ResolveReference(r).String(), nil
+}
+
+func gunzipTo(gz *os.File, w io.Writer) error {
+	if _, err := gz.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	zr, err := gzip.NewReader(gz)
+	if err != nil {
+		return fmt.Errorf("error decompressing cache: %v", err)
+	}
+	defer zr.Close()
+	if _, err := io.Copy(w, zr); err != nil {
+		return fmt.Errorf("error decompressing cache: %v", err)
+	}
+	return nil
+}
+
+// Check the database really is what the manifest describes
+func checkDownloaded(path string, m *Manifest) error {
+	db, err := openFile(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var rows []Meta
+	if err := db.Find(&rows).Error; err != nil {
+		return fmt.Errorf("downloaded file is not an apm cache: %v", err)
+	}
+	meta := map[string]string{}
+	for _, row := range rows {
+		meta[row.Key] = row.Value
+	}
+	if meta[MetaRev] != m.Rev {
+		return fmt.Errorf("downloaded cache was built from %s, manifest says %s", meta[MetaRev], m.Rev)
+	}
+	if meta[MetaSchemaVersion] != strconv.Itoa(m.SchemaVersion) {
+		return fmt.Errorf("downloaded cache has schema version %s, manifest says %d", meta[MetaSchemaVersion], m.SchemaVersion)
+	}
+	return nil
+}
+
+// Write a channel's cache as <dir>/apm[-channel].db.gz with its manifest,
+// ready to be served for apm makecache --download
+func Pack(channel, dir string) (*Manifest, error) {
+	info, err := ReadInfo(channel)
+	if err != nil {
+		return nil, err
+	}
+	if info.SchemaVersion != SchemaVersion {
+		return nil, outdatedCacheError(channel, fmt.Errorf("%w: schema version %d", ErrOutdated, info.SchemaVersion))
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	dbName, manifestName := publishedNames(channel)
+
+	src, err := os.Open(info.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	out, err := os.Create(filepath.Join(dir, dbName))
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+	h := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(out, h)}
+	zw, err := gzip.NewWriterLevel(counter, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(zw, src); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	if err := out.Close(); err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{
+		Channel:       channel,
+		File:          dbName,
+		SHA256:        hex.EncodeToString(h.Sum(nil)),
+		Size:          counter.n,
+		Rev:           info.Rev,
+		Ref:           info.Ref,
+		System:        info.System,
+		Count:         info.Count,
+		SchemaVersion: info.SchemaVersion,
+		BuiltAt:       info.BuiltAt.Format(time.RFC3339),
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, manifestName), append(data, '\n'), 0644); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,203 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Build a small nixpkgs cache in a temporary home and pack it
+func packedCache(t *testing.T) (*Manifest, []byte) {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	dir, _ := Dir()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	dbPath, _ := DBPath(DefaultChannel)
+	db, err := openFile(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range createTables {
+		if err := db.Exec(stmt).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Create(&PackageInfo{Pname: "hello", AttrPath: "hello", Version: "2.12"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	err = writeMeta(db.DB, map[string]string{
+		MetaRev:           "abc123",
+		MetaCount:         "1",
+		MetaSchemaVersion: strconv.Itoa(SchemaVersion),
+		MetaBuiltAt:       "2025-01-01T00:00:00Z",
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := t.TempDir()
+	m, err := Pack(DefaultChannel, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz, err := os.ReadFile(filepath.Join(out, m.File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, gz
+}
+
+// Serve a manifest and the compressed database, or a 404 for it when
+// gz is nil
+func serveCache(t *testing.T, m *Manifest, gz []byte) string {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/apm.json", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(m)
+	})
+	mux.HandleFunc("/"+m.File, func(w http.ResponseWriter, r *http.Request) {
+		if gz == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(gz)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestDownload(t *testing.T) {
+	m, gz := packedCache(t)
+	source := serveCache(t, m, gz)
+
+	// A fresh home without a cache
+	t.Setenv("HOME", t.TempDir())
+	got, err := Download(Channel{Name: DefaultChannel}, source, Options{Quiet: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Rev != "abc123" {
+		t.Errorf("manifest rev %q", got.Rev)
+	}
+	info, err := ReadInfo(DefaultChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Rev != "abc123" || info.Count != 1 {
+		t.Errorf("installed cache has rev %q and %d packages", info.Rev, info.Count)
+	}
+	db, err := Open(DefaultChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if p, err := db.Package("hello"); err != nil || p == nil {
+		t.Errorf("hello not in the installed cache: %v", err)
+	}
+	assertNoTempFiles(t)
+}
+
+func TestDownloadFailures(t *testing.T) {
+	m, gz := packedCache(t)
+	tests := []struct {
+		name   string
+		edit   func(m *Manifest)
+		gz     []byte
+		errMsg string
+	}{
+		{
+			name:   "checksum mismatch",
+			edit:   func(m *Manifest) { m.SHA256 = strings.Repeat("0", 64) },
+			gz:     gz,
+			errMsg: "checksum mismatch",
+		},
+		{
+			name:   "size mismatch",
+			edit:   func(m *Manifest) { m.Size++ },
+			gz:     gz,
+			errMsg: "manifest says",
+		},
+		{
+			name:   "newer schema",
+			edit:   func(m *Manifest) { m.SchemaVersion = SchemaVersion + 1 },
+			gz:     gz,
+			errMsg: "needs a newer apm",
+		},
+		{
+			name:   "different rev",
+			edit:   func(m *Manifest) { m.Rev = "def456" },
+			gz:     gz,
+			errMsg: "built from abc123",
+		},
+		{
+			name:   "failed download",
+			edit:   func(m *Manifest) {},
+			gz:     nil,
+			errMsg: "404",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bad := *m
+			tt.edit(&bad)
+			source := serveCache(t, &bad, tt.gz)
+
+			// The existing cache must survive a failed download
+			t.Setenv("HOME", t.TempDir())
+			dir, _ := Dir()
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			dbPath, _ := DBPath(DefaultChannel)
+			old := []byte("existing cache")
+			if err := os.WriteFile(dbPath, old, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := Download(Channel{Name: DefaultChannel}, source, Options{Quiet: true})
+			if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+				t.Fatalf("got error %v, want one containing %q", err, tt.errMsg)
+			}
+			data, err := os.ReadFile(dbPath)
+			if err != nil || !bytes.Equal(data, old) {
+				t.Errorf("existing apm.db changed: %q, %v", data, err)
+			}
+			assertNoTempFiles(t)
+		})
+	}
+}
+
+func TestManifestURL(t *testing.T) {
+	tests := []struct {
+		source, channel, want string
+	}{
+		{"https://example.org/cache", "nixpkgs", "https://example.org/cache/apm.json"},
+		{"https://example.org/cache/", "unstable", "https://example.org/cache/apm-unstable.json"},
+		{"https://example.org/custom.json", "unstable", "https://example.org/custom.json"},
+	}
+	for _, tt := range tests {
+		if got := ManifestURL(tt.source, tt.channel); got != tt.want {
+			t.Errorf("ManifestURL(%q, %q) = %q, want %q", tt.source, tt.channel, got, tt.want)
+		}
+	}
+}
+
+// Downloads are swapped in atomically, nothing half-written stays behind
+func assertNoTempFiles(t *testing.T) {
+	t.Helper()
+	dir, _ := Dir()
+	tmp, _ := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if len(tmp) > 0 {
+		t.Errorf("temporary files left behind: %v", tmp)
+	}
+}
@@ -0,0 +1,129 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Keys in the cache_meta table
+const (
+	MetaBuiltAt       = "built_at"
+	MetaRev           = "rev"
+	MetaRef           = "ref"
+	MetaSystem        = "system"
+	MetaCount         = "count"
+	MetaSchemaVersion = "schema_version"
+)
+
+// Fact about how a cache database was built
+type Meta struct {
+	Key   string `gorm:"primaryKey"`
+	Value string
+}
+
+func (Meta) TableName() string {
+	return "cache_meta"
+}
+
+func writeMeta(db *gorm.DB, values map[string]string) error {
+	for key, value := range values {
+		if err := db.Save(&Meta{Key: key, Value: value}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read the metadata of a channel's cache
+func ReadMeta(channel string) (map[string]string, error) {
+	dbPath, err := DBPath(channel)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return nil, MissingCacheError(channel)
+	}
+	// Read as is, status should show old caches without upgrading them
+	db, err := openFile(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	values := map[string]string{}
+	if !db.Migrator().HasTable(&Meta{}) {
+		// Built before metadata was recorded
+		return values, nil
+	}
+	var rows []Meta
+	if err := db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		values[row.Key] = row.Value
+	}
+	return values, nil
+}
+
+// What a channel's cache was built from, and when
+type Info struct {
+	Channel       string
+	Path          string
+	Size          int64
+	BuiltAt       time.Time
+	Rev           string
+	Ref           string
+	System        string
+	Count         int
+	SchemaVersion int
+}
+
+// Metadata of a channel's cache; fields stay empty for caches built
+// before they were recorded
+func ReadInfo(channel string) (*Info, error) {
+	meta, err := ReadMeta(channel)
+	if err != nil {
+		return nil, err
+	}
+	path, _ := DBPath(channel)
+	info := &Info{
+		Channel: channel,
+		Path:    path,
+		Rev:     meta[MetaRev],
+		Ref:     meta[MetaRef],
+		System:  meta[MetaSystem],
+	}
+	if fi, err := os.Stat(path); err == nil {
+		info.Size = fi.Size()
+	}
+	info.BuiltAt, _ = time.Parse(time.RFC3339, meta[MetaBuiltAt])
+	info.Count, _ = strconv.Atoi(meta[MetaCount])
+	info.SchemaVersion, _ = strconv.Atoi(meta[MetaSchemaVersion])
+	return info, nil
+}
+
+// Channels that have a cache database
+func CachedChannels() ([]string, error) {
+	dir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+	var channels []string
+	if _, err := os.Stat(filepath.Join(dir, "apm.db")); err == nil {
+		channels = append(channels, DefaultChannel)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "apm-*.db"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(f), "apm-"), ".db")
+		channels = append(channels, name)
+	}
+	return channels, nil
+}
@@ -0,0 +1,161 @@
+package cache
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Entry of `nix-env -qaP --json --meta`
+type envPackage struct {
+	Name    string `json:"name"`
+	Pname   string `json:"pname"`
+	Version string `json:"version"`
+	System  string `json:"system"`
+	Meta    struct {
+		Description     string          `json:"description"`
+		LongDescription string          `json:"longDescription"`
+		Homepage        json.RawMessage `json:"homepage"`
+		License         json.RawMessage `json:"license"`
+		Platforms       json.RawMessage `json:"platforms"`
+		MainProgram     string          `json:"mainProgram"`
+		Broken          bool            `json:"broken"`
+		// Set by nixpkgs' meta checks, missing in very old revisions
+		Unfree               *bool    `json:"unfree"`
+		Insecure             *bool    `json:"insecure"`
+		KnownVulnerabilities []string `json:"knownVulnerabilities"`
+	} `json:"meta"`
+}
+
+// One license of meta.license, which may also be a plain string
+type envLicense struct {
+	SpdxID    string `json:"spdxId"`
+	ShortName string `json:"shortName"`
+	FullName  string `json:"fullName"`
+	Free      *bool  `json:"free"`
+}
+
+func (e *envPackage) info() PackageInfo {
+	m := e.Meta
+	pkg := PackageInfo{
+		Description:     m.Description,
+		Pname:           e.Pname,
+		Version:         e.Version,
+		LongDescription: strings.TrimSpace(m.LongDescription),
+		MainProgram:     m.MainProgram,
+		Broken:          m.Broken,
+	}
+	if pkg.Pname == "" {
+		pkg.Pname = strings.TrimSuffix(e.Name, "-"+e.Version)
+	}
+	if homepages := stringsOf(m.Homepage); len(homepages) > 0 {
+		pkg.Homepage = homepages[0]
+	}
+	pkg.Platforms = strings.Join(stringsOf(m.Platforms), " ")
+
+	licenses, unfree := decodeLicenses(m.License)
+	pkg.License = strings.Join(licenses, ", ")
+	pkg.Unfree = unfree
+	if m.Unfree != nil {
+		pkg.Unfree = *m.Unfree
+	}
+	pkg.Insecure = len(m.KnownVulnerabilities) > 0
+	if m.Insecure != nil {
+		pkg.Insecure = *m.Insecure
+	}
+	return pkg
+}
+
+// License names, and whether any of them is unfree
+func decodeLicenses(raw json.RawMessage) ([]string, bool) {
+	if len(raw) == 0 {
+		return nil, false
+	}
+	var list []json.RawMessage
+	if json.Unmarshal(raw, &list) != nil {
+		list = []json.RawMessage{raw}
+	}
+	var names []string
+	unfree := false
+	for _, item := range list {
+		var name string
+		if json.Unmarshal(item, &name) == nil {
+			names = append(names, name)
+			continue
+		}
+		var l envLicense
+		if json.Unmarshal(item, &l) != nil {
+			continue
+		}
+		switch {
+		case l.SpdxID != "":
+			names = append(names, l.SpdxID)
+		case l.ShortName != "":
+			names = append(names, l.ShortName)
+		case l.FullName != "":
+			names = append(names, l.FullName)
+		}
+		if l.Free != nil && !*l.Free {
+			unfree = true
+		}
+	}
+	return names, unfree
+}
+
+// A string or the strings of a list; other values, like platform
+// patterns, are skipped
+func stringsOf(raw json.RawMessage) []string {
+	if len(raw) == 0 {
+		return nil
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return []string{s}
+	}
+	var list []json.RawMessage
+	if json.Unmarshal(raw, &list) != nil {
+		return nil
+	}
+	var out []string
+	for _, item := range list {
+		if json.Unmarshal(item, &s) == nil {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Whether the package builds for a system; unknown platforms count as yes
+func (p PackageInfo) AvailableOn(system string) bool {
+	if p.Platforms == "" || system == "" {
+		return true
+	}
+	for _, platform := range strings.Fields(p.Platforms) {
+		if platform == system {
+			return true
+		}
+	}
+	return false
+}
+
+// Reasons to think twice before installing the package on a system
+func (p PackageInfo) Warnings(system string) []string {
+	var warnings []string
+	if p.Unfree {
+		// A license named just "unfree" adds nothing to the label
+		if p.License != "" && !strings.EqualFold(p.License, "unfree") {
+			warnings = append(warnings, "unfree ("+p.License+")")
+		} else {
+			warnings = append(warnings, "unfree")
+		}
+	}
+	if p.Broken {
+		warnings = append(warnings, "marked broken")
+	}
+	if p.Insecure {
+		warnings = append(warnings, "marked insecure")
+	}
+	if !p.AvailableOn(system) {
+		warnings = append(warnings, "not available on "+system)
+	}
+	return warnings
+}
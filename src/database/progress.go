@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// How often the progress line is redrawn
+const progressInterval = 200 * time.Millisecond
+
+// Package count, elapsed time and rate while the cache is built
+type progress struct {
+	quiet    bool
+	terminal bool
+	count    int
+	start    time.Time
+	last     time.Time
+}
+
+func newProgress(quiet bool) *progress {
+	fi, err := os.Stdout.Stat()
+	terminal := err == nil && fi.Mode()&os.ModeCharDevice != 0
+	return &progress{quiet: quiet, terminal: terminal, start: time.Now()}
+}
+
+func (p *progress) Tick() {
+	p.count++
+	if p.quiet || !p.terminal {
+		return
+	}
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		fmt.Printf("\r%s", p.line())
+	}
+}
+
+// Print the final counts
+func (p *progress) Done() {
+	if p.quiet {
+		return
+	}
+	if p.terminal {
+		fmt.Printf("\r%s\n", p.line())
+		return
+	}
+	fmt.Println(p.line())
+}
+
+func (p *progress) line() string {
+	elapsed := time.Since(p.start)
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(p.count) / elapsed.Seconds()
+	}
+	return fmt.Sprintf("Read %d packages in %s (%.0f/s)", p.count, elapsed.Round(100*time.Millisecond), rate)
+}
@@ -0,0 +1,268 @@
+package cache
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+)
+
+// Version of the cache database layout, bumped with every migration
+const SchemaVersion = 2
+
+var (
+	// The channel has no cache database yet
+	ErrNoCache = errors.New("no package cache")
+	// The cache database can't be used or upgraded and needs a rebuild
+	ErrOutdated = errors.New("package cache is out of date")
+)
+
+// Package row of the cache, also used for Flathub search results
+type PackageInfo struct {
+	Description string
+	Pname       string
+	Version     string
+	// Attribute path inside nixpkgs, e.g. kdePackages.kate
+	AttrPath string
+	// Set holding the attribute, e.g. kdePackages, empty at the top level
+	PackageSet string
+
+	// From meta, empty in caches built before schema version 2
+	License  string
+	Homepage string
+	// Space separated systems, empty when unrestricted
+	Platforms       string
+	MainProgram     string
+	LongDescription string
+	Unfree          bool
+	Broken          bool
+	Insecure        bool
+}
+
+func (PackageInfo) TableName() string {
+	return "package_infos"
+}
+
+// Name to install by: the attribute path, or pname for Flathub
+func (p PackageInfo) Attr() string {
+	if p.AttrPath != "" {
+		return p.AttrPath
+	}
+	return p.Pname
+}
+
+// Tables of the current layout, created before the rows are loaded
+var createTables = []string{
+	`CREATE TABLE IF NOT EXISTS package_infos (
+		description TEXT, pname TEXT, version TEXT, attr_path TEXT, package_set TEXT,
+		license TEXT, homepage TEXT, platforms TEXT, main_program TEXT, long_description TEXT,
+		unfree BOOLEAN DEFAULT false, broken BOOLEAN DEFAULT false, insecure BOOLEAN DEFAULT false)`,
+	"CREATE TABLE IF NOT EXISTS cache_meta (key TEXT PRIMARY KEY, value TEXT)",
+}
+
+// Step bringing a database from version To-1 to To
+type migration struct {
+	To          int
+	Description string
+	Up          func(db *gorm.DB) error
+}
+
+// Every change to the layout, in order. A cache built from scratch runs
+// them too, once its rows are loaded, so indexes are built in one go.
+var migrations = []migration{
+	{1, "attribute path indexes, search index and metadata", migrateV1},
+	{2, "license, homepage, platforms and flags", migrateV2},
+}
+
+// Caches from before versioning; only those that already store
+// attribute paths can be upgraded, the others lack the data
+func migrateV1(db *gorm.DB) error {
+	if !db.Migrator().HasColumn(&PackageInfo{}, "attr_path") {
+		return fmt.Errorf("%w: it predates attribute paths", ErrOutdated)
+	}
+	for _, stmt := range append(createTables,
+		"CREATE INDEX IF NOT EXISTS idx_package_infos_pname ON package_infos(pname)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_package_infos_attr_path ON package_infos(attr_path)",
+	) {
+		if err := db.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	if db.Migrator().HasTable(searchTable) {
+		return nil
+	}
+	return buildSearchIndex(db)
+}
+
+// Package meta columns. Upgraded caches keep them empty until rebuilt.
+func migrateV2(db *gorm.DB) error {
+	columns := []struct{ name, def string }{
+		{"license", "TEXT"},
+		{"homepage", "TEXT"},
+		{"platforms", "TEXT"},
+		{"main_program", "TEXT"},
+		{"long_description", "TEXT"},
+		{"unfree", "BOOLEAN DEFAULT false"},
+		{"broken", "BOOLEAN DEFAULT false"},
+		{"insecure", "BOOLEAN DEFAULT false"},
+	}
+	for _, c := range columns {
+		// New caches already have them
+		if db.Migrator().HasColumn(&PackageInfo{}, c.name) {
+			continue
+		}
+		if err := db.Exec("ALTER TABLE package_infos ADD COLUMN " + c.name + " " + c.def).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Version recorded in the database, 0 for caches from before versioning
+func schemaVersion(db *gorm.DB) (int, error) {
+	if !db.Migrator().HasTable(&Meta{}) {
+		return 0, nil
+	}
+	var value string
+	err := db.Raw("SELECT value FROM cache_meta WHERE key = ?", MetaSchemaVersion).Scan(&value).Error
+	if err != nil {
+		return 0, err
+	}
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// Run the migrations a database is missing, each in its own transaction
+func migrate(db *gorm.DB, from int) error {
+	for _, m := range migrations {
+		if m.To <= from {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return writeMeta(tx, map[string]string{MetaSchemaVersion: strconv.Itoa(m.To)})
+		})
+		if errors.Is(err, ErrOutdated) {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("migration to schema %d (%s): %w", m.To, m.Description, err)
+		}
+	}
+	return nil
+}
+
+// Open cache database
+type DB struct {
+	*gorm.DB
+	Channel string
+
+	sqlDB *sql.DB
+}
+
+// Open a channel's cache, upgrading older layouts in place. Fails with
+// ErrNoCache or ErrOutdated when the cache needs to be (re)built.
+func Open(channel string) (*DB, error) {
+	dbPath, err := DBPath(channel)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return nil, MissingCacheError(channel)
+	}
+	db, err := openFile(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := schemaVersion(db.DB)
+	if err == nil && version < SchemaVersion {
+		if err = migrate(db.DB, version); err == nil {
+			fmt.Printf("Upgraded the %s cache to schema version %d\n", channel, SchemaVersion)
+		}
+	}
+	if err == nil && version > SchemaVersion {
+		err = fmt.Errorf("%w: it was built by a newer apm", ErrOutdated)
+	}
+	if err != nil {
+		db.Close()
+		if errors.Is(err, ErrOutdated) {
+			return nil, outdatedCacheError(channel, err)
+		}
+		return nil, fmt.Errorf("error opening the %s cache: %v", channel, err)
+	}
+	db.Channel = channel
+	return db, nil
+}
+
+// Connect to a database file as it is
+func openFile(path string) (*DB, error) {
+	// Bulk loading trips the slow query log and lookups log missing
+	// records, errors are returned instead
+	gdb, err := gorm.Open(sqlite.Open(path), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to database: %v", err)
+	}
+	sqlDB, err := gdb.DB()
+	if err != nil {
+		return nil, err
+	}
+	return &DB{DB: gdb, sqlDB: sqlDB}, nil
+}
+
+func (db *DB) Close() error {
+	return db.sqlDB.Close()
+}
+
+// Package by attribute path, nil when the cache doesn't have it
+func (db *DB) Package(attrPath string) (*PackageInfo, error) {
+	var pkgs []PackageInfo
+	if err := db.Where("attr_path = ?", attrPath).Limit(1).Find(&pkgs).Error; err != nil {
+		return nil, err
+	}
+	if len(pkgs) == 0 {
+		return nil, nil
+	}
+	return &pkgs[0], nil
+}
+
+// Packages whose attribute path or name contains query: exact matches
+// first, then prefixes, then the rest
+func (db *DB) FindByName(query string, limit int) ([]PackageInfo, error) {
+	contains, prefix := "%"+escapeLike(query)+"%", escapeLike(query)+"%"
+	var pkgs []PackageInfo
+	err := db.Where(`attr_path LIKE ? ESCAPE '\' OR pname LIKE ? ESCAPE '\'`, contains, contains).
+		Order(clause.Expr{
+			SQL: `CASE WHEN attr_path = ? THEN 0 WHEN pname = ? THEN 1
+				WHEN attr_path LIKE ? ESCAPE '\' OR pname LIKE ? ESCAPE '\' THEN 2 ELSE 3 END, length(attr_path), attr_path`,
+			Vars: []any{query, query, prefix, prefix},
+		}).
+		Limit(limit).
+		Find(&pkgs).Error
+	return pkgs, err
+}
+
+// Escape LIKE wildcards so they match themselves, for use with ESCAPE '\'
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// Error for a cache that has to be rebuilt
+func outdatedCacheError(channel string, err error) error {
+	rebuild := "apm makecache"
+	if channel != DefaultChannel {
+		rebuild += " --channel " + channel
+	}
+	return fmt.Errorf("the %s cache can't be used, %w; rebuild it with '%s'", channel, err, rebuild)
+}
@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Full-text index over package_infos
+const searchTable = "package_search"
+
+// Build the full-text index from the loaded packages
+func buildSearchIndex(db *gorm.DB) error {
+	stmts := []string{
+		"DROP TABLE IF EXISTS " + searchTable,
+		"CREATE VIRTUAL TABLE " + searchTable + " USING fts5(pname, description, attr_path, content='package_infos')",
+		"INSERT INTO " + searchTable + "(" + searchTable + ") VALUES('rebuild')",
+	}
+	for _, stmt := range stmts {
+		if err := db.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ranked full-text search of a channel, returning one page of results and the total
+func Search(channel string, terms []string, limit, offset int) ([]PackageInfo, int, error) {
+	match, err := MatchQuery(terms)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	db, err := Open(channel)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer db.Close()
+
+	var total int
+	err = db.Raw("SELECT count(*) FROM "+searchTable+" WHERE "+searchTable+" MATCH ?", match).Scan(&total).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Name matches weigh most, then attribute paths, then descriptions
+	var results []PackageInfo
+	err = db.Raw(`SELECT p.*
+		FROM `+searchTable+` s JOIN package_infos p ON p.rowid = s.rowid
+		WHERE s.`+searchTable+` MATCH ?
+		ORDER BY bm25(s.`+searchTable+`, 10.0, 1.0, 5.0), p.pname
+		LIMIT ? OFFSET ?`, match, limit, offset).Scan(&results).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return results, total, nil
+}
+
+// Turn search arguments into an FTS5 query. Words match as prefixes and
+// must all be present; "quoted text", or an argument with spaces in it,
+// matches as a phrase.
+func MatchQuery(terms []string) (string, error) {
+	var parts []string
+	for _, term := range terms {
+		if !strings.Contains(term, `"`) {
+			if words := strings.Fields(term); len(words) > 1 {
+				parts = append(parts, phrase(words))
+				continue
+			}
+		}
+		// Odd segments are inside quotes
+		for i, segment := range strings.Split(term, `"`) {
+			words := strings.Fields(segment)
+			if len(words) == 0 {
+				continue
+			}
+			if i%2 == 1 {
+				parts = append(parts, phrase(words))
+				continue
+			}
+			for _, w := range words {
+				parts = append(parts, quote(w)+"*")
+			}
+		}
+	}
+	if len(parts) == 0 {
+		return "", fmt.Errorf("empty search")
+	}
+	return strings.Join(parts, " AND "), nil
+}
+
+func phrase(words []string) string {
+	return quote(strings.Join(words, " "))
+}
+
+// FTS5 string, with embedded quotes doubled
+func quote(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
@@ -0,0 +1,146 @@
+package cache
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Cache for the default channel in a temporary home holding pkgs
+func testCache(t *testing.T, pkgs []PackageInfo) {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	dir, _ := Dir()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	dbPath, _ := DBPath(DefaultChannel)
+	db, err := openFile(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, stmt := range createTables {
+		if err := db.Exec(stmt).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Create(&pkgs).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := buildSearchIndex(db.DB); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeMeta(db.DB, map[string]string{MetaSchemaVersion: strconv.Itoa(SchemaVersion)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMatchQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		terms []string
+		want  string
+	}{
+		{"one word", []string{"git"}, `"git"*`},
+		{"several terms", []string{"pdf", "viewer"}, `"pdf"* AND "viewer"*`},
+		{"words in one argument", []string{"pdf viewer"}, `"pdf viewer"`},
+		{"quoted phrase", []string{`"pdf viewer" gnome`}, `"pdf viewer" AND "gnome"*`},
+		{"phrase and words", []string{`gtk "pdf viewer"`, "gnome"}, `"gtk"* AND "pdf viewer" AND "gnome"*`},
+		{"fts syntax is quoted", []string{"c++", "OR", "NEAR(a"}, `"c++"* AND "OR"* AND "NEAR(a"*`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MatchQuery(tt.terms)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("MatchQuery(%q) = %s, want %s", tt.terms, got, tt.want)
+			}
+		})
+	}
+
+	for _, terms := range [][]string{nil, {""}, {" ", `""`}} {
+		if _, err := MatchQuery(terms); err == nil {
+			t.Errorf("MatchQuery(%q) should fail", terms)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	testCache(t, []PackageInfo{
+		{Pname: "evince", AttrPath: "evince", Description: "GNOME's document viewer"},
+		{Pname: "zathura", AttrPath: "zathura", Description: "A highly customizable document viewer"},
+		{Pname: "git", AttrPath: "git", Description: "Distributed version control system"},
+	})
+	tests := []struct {
+		terms []string
+		want  []string
+	}{
+		{[]string{"document", "viewer"}, []string{"evince", "zathura"}},
+		{[]string{`"document viewer"`}, []string{"evince", "zathura"}},
+		{[]string{"highly customizable"}, []string{"zathura"}},
+		{[]string{"viewer document"}, nil},
+		{[]string{"gi"}, []string{"git"}},
+	}
+	for _, tt := range tests {
+		pkgs, total, err := Search(DefaultChannel, tt.terms, 10, 0)
+		if err != nil {
+			t.Fatalf("Search(%q): %v", tt.terms, err)
+		}
+		if got := attrPaths(pkgs); got != strings.Join(tt.want, " ") || total != len(tt.want) {
+			t.Errorf("Search(%q) = %q (%d total), want %q", tt.terms, got, total, tt.want)
+		}
+	}
+}
+
+func TestFindByName(t *testing.T) {
+	testCache(t, []PackageInfo{
+		{Pname: "python3", AttrPath: "python312"},
+		{Pname: "python3", AttrPath: "python3_12"},
+		{Pname: "foobar", AttrPath: "foobar"},
+		{Pname: "foo%bar", AttrPath: "foo-percent"},
+		{Pname: `back\slash`, AttrPath: "backslash"},
+		{Pname: "git", AttrPath: "git"},
+		{Pname: "git-lfs", AttrPath: "git-lfs"},
+		{Pname: "gitFull", AttrPath: "gitFull"},
+		{Pname: "legit", AttrPath: "legit"},
+	})
+	db, err := Open(DefaultChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		// Wildcards only match themselves
+		{"3_1", "python3_12"},
+		{"%", "foo-percent"},
+		{"o%b", "foo-percent"},
+		{`k\s`, "backslash"},
+		// Exact, then prefixes, then the rest
+		{"git", "git git-lfs gitFull legit"},
+	}
+	for _, tt := range tests {
+		pkgs, err := db.FindByName(tt.query, 10)
+		if err != nil {
+			t.Fatalf("FindByName(%q): %v", tt.query, err)
+		}
+		if got := attrPaths(pkgs); got != tt.want {
+			t.Errorf("FindByName(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func attrPaths(pkgs []PackageInfo) string {
+	paths := make([]string, len(pkgs))
+	for i, p := range pkgs {
+		paths[i] = p.AttrPath
+	}
+	return strings.Join(paths, " ")
+}
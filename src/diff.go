@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Lines of context around each hunk
+const diffContext = 3
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	text string
+}
+
+// Unified diff between two file contents, empty when they are equal
+func unifiedDiff(oldName, newName string, a, b []byte) string {
+	ops := diffLines(splitLines(string(a)), splitLines(string(b)))
+
+	var changed []int
+	for i, op := range ops {
+		if op.kind != ' ' {
+			changed = append(changed, i)
+		}
+	}
+	if len(changed) == 0 {
+		return ""
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", oldName, newName)
+
+	for k := 0; k < len(changed); {
+		start := max(changed[k]-diffContext, 0)
+		end := min(changed[k]+1+diffContext, len(ops))
+		// Merge changes whose context would overlap
+		for k++; k < len(changed) && changed[k]-diffContext <= end; k++ {
+			end = min(changed[k]+1+diffContext, len(ops))
+		}
+		writeHunk(&out, ops, start, end)
+	}
+	return out.String()
+}
+
+func writeHunk(out *strings.Builder, ops []diffOp, start, end int) {
+	oldLine, newLine := 0, 0
+	for _, op := range ops[:start] {
+		if op.kind != '+' {
+			oldLine++
+		}
+		if op.kind != '-' {
+			newLine++
+		}
+	}
+	oldCount, newCount := 0, 0
+	for _, op := range ops[start:end] {
+		if op.kind != '+' {
+			oldCount++
+		}
+		if op.kind != '-' {
+			newCount++
+		}
+	}
+	// Empty ranges point at the line before them
+	if oldCount > 0 {
+		oldLine++
+	}
+	if newCount > 0 {
+		newLine++
+	}
+	fmt.Fprintf(out, "@@ -%d,%d +%d,%d @@\n", oldLine, oldCount, newLine, newCount)
+	for _, op := range ops[start:end] {
+		out.WriteByte(op.kind)
+		out.WriteString(op.text)
+		if !strings.HasSuffix(op.text, "\n") {
+			out.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// Lines including their newline
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Line diff based on the longest common subsequence. The table is
+// len(midA)×len(midB) ints for the lines between the common prefix and
+// suffix, fine for the small edits apm makes to config files but
+// quadratic in memory for large rewrites.
+func diffLines(a, b []string) []diffOp {
+	// Common prefix and suffix need no table
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	midA, midB := a[pre:len(a)-suf], b[pre:len(b)-suf]
+
+	// lcs[i][j] is the LCS length of midA[i:] and midB[j:]
+	lcs := make([][]int, len(midA)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(midB)+1)
+	}
+	for i := len(midA) - 1; i >= 0; i-- {
+		for j := len(midB) - 1; j >= 0; j-- {
+			if midA[i] == midB[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var ops []diffOp
+	for _, line := range a[:pre] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	i, j := 0, 0
+	for i < len(midA) || j < len(midB) {
+		switch {
+		case i < len(midA) && j < len(midB) && midA[i] == midB[j]:
+			ops = append(ops, diffOp{' ', midA[i]})
+			i++
+			j++
+		case j < len(midB) && (i == len(midA) || lcs[i][j+1] > lcs[i+1][j]):
+			ops = append(ops, diffOp{'+', midB[j]})
+			j++
+		default:
+			ops = append(ops, diffOp{'-', midA[i]})
+			i++
+		}
+	}
+	for _, line := range a[len(a)-suf:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
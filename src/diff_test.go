@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Numbered lines from..to, each ending in a newline
+func numberedLines(from, to int) string {
+	var b strings.Builder
+	for i := from; i <= to; i++ {
+		b.WriteString(strings.Repeat("x", i) + "\n")
+	}
+	return b.String()
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	long := numberedLines(1, 20)
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{
+			name: "equal",
+			a:    "a\nb\n",
+			b:    "a\nb\n",
+			want: "",
+		},
+		{
+			name: "insert at start",
+			a:    "a\nb\n",
+			b:    "x\na\nb\n",
+			want: "@@ -1,2 +1,3 @@\n+x\n a\n b\n",
+		},
+		{
+			name: "delete at start",
+			a:    "x\na\nb\n",
+			b:    "a\nb\n",
+			want: "@@ -1,3 +1,2 @@\n-x\n a\n b\n",
+		},
+		{
+			name: "insert at end",
+			a:    "a\nb\n",
+			b:    "a\nb\nc\n",
+			want: "@@ -1,2 +1,3 @@\n a\n b\n+c\n",
+		},
+		{
+			name: "delete at end",
+			a:    "a\nb\nc\n",
+			b:    "a\nb\n",
+			want: "@@ -1,3 +1,2 @@\n a\n b\n-c\n",
+		},
+		{
+			name: "new file",
+			a:    "",
+			b:    "a\nb\n",
+			want: "@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			name: "deleted file",
+			a:    "a\nb\n",
+			b:    "",
+			want: "@@ -1,2 +0,0 @@\n-a\n-b\n",
+		},
+		{
+			name: "missing trailing newline",
+			a:    "a\nb",
+			b:    "a\nc",
+			want: "@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+c\n\\ No newline at end of file\n",
+		},
+		{
+			name: "trailing newline added",
+			a:    "a\nb",
+			b:    "a\nb\n",
+			want: "@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n",
+		},
+		{
+			name: "nearby changes share a hunk",
+			a:    long,
+			b:    strings.Replace(strings.Replace(long, "xxx\n", "three\n", 1), "xxxxxxxxx\n", "nine\n", 1),
+			want: "@@ -1,12 +1,12 @@\n x\n xx\n-xxx\n+three\n" + prefixLines(numberedLines(4, 8), " ") +
+				"-xxxxxxxxx\n+nine\n" + prefixLines(numberedLines(10, 12), " "),
+		},
+		{
+			name: "distant changes get their own hunks",
+			a:    long,
+			b:    strings.Replace(strings.Replace(long, "xx\n", "two\n", 1), strings.Repeat("x", 18)+"\n", "eighteen\n", 1),
+			want: "@@ -1,5 +1,5 @@\n x\n-xx\n+two\n" + prefixLines(numberedLines(3, 5), " ") +
+				"@@ -15,6 +15,6 @@\n" + prefixLines(numberedLines(15, 17), " ") + "-" + strings.Repeat("x", 18) + "\n+eighteen\n" + prefixLines(numberedLines(19, 20), " "),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := unifiedDiff("a/f", "b/f", []byte(tt.a), []byte(tt.b))
+			want := tt.want
+			if want != "" {
+				want = "--- a/f\n+++ b/f\n" + want
+			}
+			if got != want {
+				t.Errorf("got\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func prefixLines(s, prefix string) string {
+	lines := splitLines(s)
+	for i := range lines {
+		lines[i] = prefix + lines[i]
+	}
+	return strings.Join(lines, "")
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"alloylinux/apm/src/nix"
+	"strings"
+)
+
+// Input declared in flake.nix
+type flakeInput struct {
+	Name    string
+	URL     string
+	URLNode *nix.StringLit
+	// Followed inputs, e.g. "home-manager.inputs.nixpkgs" -> "nixpkgs"
+	Follows [][2]string
+}
+
+// Inputs of a parsed flake.nix, in declaration order.
+// Also returns the `inputs = { ... }` attrset and the last top-level
+// `inputs.*` binding, either of which may be nil.
+func flakeInputs(f *nix.File) ([]*flakeInput, *nix.AttrSet, *nix.Attr) {
+	root, ok := f.Root.(*nix.AttrSet)
+	if !ok {
+		return nil, nil, nil
+	}
+
+	var inputs []*flakeInput
+	byName := map[string]*flakeInput{}
+	get := func(name string) *flakeInput {
+		if in, ok := byName[name]; ok {
+			return in
+		}
+		in := &flakeInput{Name: name}
+		byName[name] = in
+		inputs = append(inputs, in)
+		return in
+	}
+
+	var inputsSet *nix.AttrSet
+	var lastInputsAttr *nix.Attr
+	for _, b := range root.Bindings {
+		attr, ok := b.(*nix.Attr)
+		if !ok {
+			continue
+		}
+		path := nix.AttrNames(attr.Path)
+		if path[0] != "inputs" {
+			continue
+		}
+		if len(path) == 1 {
+			if set, ok := attr.Value.(*nix.AttrSet); ok {
+				inputsSet = set
+			}
+		} else {
+			lastInputsAttr = attr
+		}
+		for _, leaf := range flattenBindings(attr.Value, path) {
+			if len(leaf.path) < 3 {
+				continue
+			}
+			in := get(leaf.path[1])
+			rest := leaf.path[2:]
+			value, _ := leaf.value.(*nix.StringLit)
+			switch {
+			case len(rest) == 1 && rest[0] == "url" && value != nil:
+				in.URL, _ = value.Value()
+				in.URLNode = value
+			case rest[len(rest)-1] == "follows" && value != nil:
+				target, _ := value.Value()
+				from := strings.Join(leaf.path[1:len(leaf.path)-1], ".")
+				in.Follows = append(in.Follows, [2]string{from, target})
+			}
+		}
+	}
+	return inputs, inputsSet, lastInputsAttr
+}
+
+type bindingLeaf struct {
+	path  []string
+	value nix.Node
+}
+
+// Expand nested attrsets into full attribute paths
+func flattenBindings(value nix.Node, prefix []string) []bindingLeaf {
+	set, ok := value.(*nix.AttrSet)
+	if !ok || set.Rec {
+		return []bindingLeaf{{path: prefix, value: value}}
+	}
+	var leaves []bindingLeaf
+	for _, b := range set.Bindings {
+		attr, ok := b.(*nix.Attr)
+		if !ok {
+			continue
+		}
+		path := append(append([]string{}, prefix...), nix.AttrNames(attr.Path)...)
+		leaves = append(leaves, flattenBindings(attr.Value, path)...)
+	}
+	return leaves
+}
+
+// Find an input by name
+func findInput(inputs []*flakeInput, name string) *flakeInput {
+	for _, in := range inputs {
+		if in.Name == name {
+			return in
+		}
+	}
+	return nil
+}
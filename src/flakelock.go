@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// flake.lock contents needed to pin inputs
+type flakeLock struct {
+	Nodes map[string]lockNode `json:"nodes"`
+	Root  string              `json:"root"`
+}
+
+type lockNode struct {
+	// Input name to node name, or to a follows path
+	Inputs map[string]json.RawMessage `json:"inputs"`
+	Locked map[string]any             `json:"locked"`
+}
+
+// Locked source of an input
+type lockedInput struct {
+	Rev string
+	// Flake reference pinned to the locked source
+	Ref string
+}
+
+// Read flake.lock next to flake.nix
+func readFlakeLock(flakeDir string) (*flakeLock, error) {
+	data, err := os.ReadFile(filepath.Join(flakeDir, "flake.lock"))
+	if err != nil {
+		return nil, err
+	}
+	var lock flakeLock
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("error parsing flake.lock: %v", err)
+	}
+	if lock.Root == "" {
+		lock.Root = "root"
+	}
+	return &lock, nil
+}
+
+// Locked source of a top-level input
+func (l *flakeLock) input(name string) (*lockedInput, bool) {
+	nodeName, ok := l.resolve(l.Root, []string{name}, 0)
+	if !ok {
+		return nil, false
+	}
+	node := l.Nodes[nodeName]
+	ref := lockedRef(node.Locked)
+	if ref == "" {
+		return nil, false
+	}
+	rev, _ := node.Locked["rev"].(string)
+	return &lockedInput{Rev: rev, Ref: ref}, true
+}
+
+// Node reached by an input path, resolving `follows` on the way
+func (l *flakeLock) resolve(from string, path []string, depth int) (string, bool) {
+	if depth > 32 {
+		// Cyclic follows
+		return "", false
+	}
+	if len(path) == 0 {
+		_, ok := l.Nodes[from]
+		return from, ok
+	}
+	raw, ok := l.Nodes[from].Inputs[path[0]]
+	if !ok {
+		return "", false
+	}
+	var target string
+	if err := json.Unmarshal(raw, &target); err == nil {
+		return l.resolve(target, path[1:], depth+1)
+	}
+	// A list is a follows path from the root
+	var follows []string
+	if err := json.Unmarshal(raw, &follows); err != nil {
+		return "", false
+	}
+	followed, ok := l.resolve(l.Root, follows, depth+1)
+	if !ok {
+		return "", false
+	}
+	return l.resolve(followed, path[1:], depth+1)
+}
+
+// Flake reference for a locked source, empty when unsupported
+func lockedRef(locked map[string]any) string {
+	str := func(key string) string {
+		s, _ := locked[key].(string)
+		return s
+	}
+	switch str("type") {
+	case "github", "gitlab", "sourcehut":
+		if str("owner") == "" || str("repo") == "" || str("rev") == "" {
+			return ""
+		}
+		ref := fmt.Sprintf("%s:%s/%s/%s", str("type"), str("owner"), str("repo"), str("rev"))
+		if host := str("host"); host != "" {
+			ref += "?host=" + host
+		}
+		return ref
+	case "git":
+		if str("url") == "" || str("rev") == "" {
+			return ""
+		}
+		return fmt.Sprintf("git+%s?rev=%s", str("url"), str("rev"))
+	case "tarball", "file":
+		// Locked URLs are already immutable
+		return str("type") + "+" + str("url")
+	case "path":
+		return "path:" + str("path")
+	}
+	return ""
+}
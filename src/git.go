@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Git repository holding the flake
+type gitRepo struct {
+	Root string
+}
+
+// Find the work tree containing dir, nil when there is none
+func findGitRepo(dir string) *gitRepo {
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "--show-toplevel").Output()
+	if err != nil {
+		// Not a repository, or git is not installed
+		return nil
+	}
+	return &gitRepo{Root: strings.TrimSpace(string(out))}
+}
+
+func (r *gitRepo) git(args ...string) *exec.Cmd {
+	return exec.Command("git", append([]string{"-C", r.Root}, args...)...)
+}
+
+// Uncommitted changes in the work tree, as `git status --porcelain` lines
+func (r *gitRepo) uncommitted() ([]string, error) {
+	out, err := r.git("status", "--porcelain").Output()
+	if err != nil {
+		return nil, fmt.Errorf("git status failed: %v", err)
+	}
+	var lines []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// Whether git knows about the path
+func (r *gitRepo) tracked(path string) bool {
+	return r.git("ls-files", "--error-unmatch", "--", path).Run() == nil
+}
+
+// Check the flake repository before a transaction writes anything.
+// Auto-commit refuses to mix its commits with unrelated changes,
+// otherwise they only get a warning.
+func gitPreflight(repo *gitRepo) error {
+	dirty, err := repo.uncommitted()
+	if err != nil {
+		return err
+	}
+	if len(dirty) == 0 {
+		return nil
+	}
+	if gitAutoCommitEnabled() && !changes.DryRun {
+		return fmt.Errorf("%s has uncommitted changes; commit or stash them first, or turn off auto-commit with 'apm config set git_autocommit off'", repo.Root)
+	}
+	fmt.Printf("Warning: %s has uncommitted changes:\n", repo.Root)
+	for _, line := range dirty {
+		fmt.Printf("  %s\n", line)
+	}
+	return nil
+}
+
+// Stage files a transaction created, and commit everything it touched
+// when auto-commit is on. Flakes ignore files git does not know about.
+func gitRecord(repo *gitRepo, tx *Transaction) {
+	var created, touched []string
+	for _, f := range tx.Files {
+		rel, err := filepath.Rel(repo.Root, f.Path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			// Outside the repository
+			continue
+		}
+		exists := f.After != ""
+		if exists && !repo.tracked(rel) {
+			created = append(created, rel)
+		}
+		if exists || repo.tracked(rel) {
+			touched = append(touched, rel)
+		}
+	}
+
+	if len(created) > 0 {
+		if err := gitRun(repo.git(append([]string{"add", "--"}, created...)...)); err != nil {
+			fmt.Printf("Warning: could not stage new files: %v\n", err)
+			return
+		}
+		fmt.Printf("Staged %s\n", strings.Join(created, ", "))
+	}
+
+	if !gitAutoCommitEnabled() || len(touched) == 0 {
+		return
+	}
+	if err := gitRun(repo.git(append([]string{"add", "-A", "--"}, touched...)...)); err != nil {
+		fmt.Printf("Warning: could not stage changes: %v\n", err)
+		return
+	}
+	message := "apm: " + tx.Description
+	if err := gitRun(repo.git(append([]string{"commit", "-q", "-m", message, "--"}, touched...)...)); err != nil {
+		fmt.Printf("Warning: could not commit changes: %v\n", err)
+		return
+	}
+	fmt.Printf("Committed \"%s\"\n", message)
+}
+
+// Run a git command, returning its error output on failure
+func gitRun(cmd *exec.Cmd) error {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%v: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// Whether each apm operation is committed to the flake repository
+func gitAutoCommitEnabled() bool {
+	return settings.GitAutoCommit
+}
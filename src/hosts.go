@@ -0,0 +1,354 @@
+package main
+
+import (
+	"alloylinux/apm/src/nix"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Host picked with --host or a profile's flake#host, empty for all hosts
+var activeHost string
+
+// nixosConfigurations or homeConfigurations entry of flake.nix
+type flakeHost struct {
+	Name string
+	// From homeConfigurations, built with home-manager switch
+	Home bool
+	// The value, usually a nixpkgs.lib.nixosSystem call
+	Value nix.Node
+	// Module files of the host, imports followed
+	Files []string
+}
+
+// Pick the host from --host, then the active profile's flake#host
+func selectHost(flag string) {
+	if flag != "" {
+		activeHost = flag
+		return
+	}
+	_, activeHost = splitFlakeRef(profileFlake())
+}
+
+// Split a flake reference like /etc/nixos#laptop
+func splitFlakeRef(ref string) (dir, host string) {
+	dir, host, _ = strings.Cut(ref, "#")
+	return dir, host
+}
+
+// nixosConfigurations.<name> and homeConfigurations.<name> bindings of
+// a parsed flake.nix, in order
+func hostsInFlake(f *nix.File) []*flakeHost {
+	var hosts []*flakeHost
+	var walk func(n nix.Node, prefix []string)
+	walk = func(n nix.Node, prefix []string) {
+		switch n := n.(type) {
+		case *nix.AttrSet:
+			for _, b := range n.Bindings {
+				attr, ok := b.(*nix.Attr)
+				if !ok {
+					continue
+				}
+				path := append([]string{}, prefix...)
+				for _, part := range attr.Path {
+					// Names like "alice@laptop" are quoted
+					name, ok := nix.AttrName(part)
+					if !ok {
+						name = "${...}"
+					}
+					path = append(path, name)
+				}
+				if n := len(path); n >= 2 && (path[n-2] == "nixosConfigurations" || path[n-2] == "homeConfigurations") {
+					hosts = append(hosts, &flakeHost{Name: path[n-1], Home: path[n-2] == "homeConfigurations", Value: attr.Value})
+					continue
+				}
+				walk(attr.Value, path)
+			}
+		case *nix.Let:
+			for _, b := range n.Bindings {
+				if attr, ok := b.(*nix.Attr); ok {
+					walk(attr.Value, nil)
+				}
+			}
+			walk(n.Body, prefix)
+		default:
+			for _, c := range nix.Children(n) {
+				walk(c, prefix)
+			}
+		}
+	}
+	walk(f.Root, nil)
+	return hosts
+}
+
+// Hosts of the flake with the module files each one uses
+func flakeHosts(flakeDir string) ([]*flakeHost, error) {
+	flakePath := filepath.Join(flakeDir, "flake.nix")
+	f, err := parseNixFile(flakePath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading flake.nix: %v", err)
+	}
+	hosts := hostsInFlake(f)
+	for _, h := range hosts {
+		seen := map[string]bool{}
+		for _, path := range modulePaths(h.Value, flakeDir, flakeDir) {
+			h.Files = followImports(path, flakeDir, seen, h.Files)
+		}
+		sort.Strings(h.Files)
+	}
+	return hosts, nil
+}
+
+// Find a host by name
+func findHost(flakeDir, name string) (*flakeHost, error) {
+	hosts, err := flakeHosts(flakeDir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, h := range hosts {
+		if h.Name == name {
+			return h, nil
+		}
+		names = append(names, h.Name)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("host '%s' not found: flake.nix has no nixosConfigurations or homeConfigurations", name)
+	}
+	return nil, fmt.Errorf("host '%s' not found in flake.nix (hosts: %s)", name, strings.Join(names, ", "))
+}
+
+// .nix files of the flake that relative path literals under n point to
+func modulePaths(n nix.Node, baseDir, flakeDir string) []string {
+	var paths []string
+	nix.Inspect(n, func(n nix.Node) bool {
+		lit, ok := n.(*nix.Literal)
+		if !ok || lit.Kind != nix.TokPath || !strings.HasPrefix(lit.Text, ".") {
+			return true
+		}
+		if path, ok := resolveModule(filepath.Join(baseDir, lit.Text), flakeDir); ok {
+			paths = append(paths, path)
+		}
+		return true
+	})
+	return paths
+}
+
+// Module file for a path: the file itself or a directory's default.nix,
+// as long as it is inside the flake
+func resolveModule(path, flakeDir string) (string, bool) {
+	rel, err := filepath.Rel(flakeDir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, "default.nix")
+	}
+	if !strings.HasSuffix(path, ".nix") {
+		return "", false
+	}
+	// Files a dry run created count too
+	if _, err := changes.ReadFile(path); err != nil {
+		return "", false
+	}
+	return path, true
+}
+
+// Add a module and every file it refers to
+func followImports(path, flakeDir string, seen map[string]bool, files []string) []string {
+	if seen[path] {
+		return files
+	}
+	seen[path] = true
+	files = append(files, path)
+	f, err := parseNixFile(path)
+	if err != nil {
+		return files
+	}
+	for _, p := range modulePaths(f.Root, filepath.Dir(path), flakeDir) {
+		files = followImports(p, flakeDir, seen, files)
+	}
+	return files
+}
+
+// Lists inside the active host's entry
+func hostLists(f *nix.File, lists []nix.ListMatch) []nix.ListMatch {
+	var kept []nix.ListMatch
+	for _, h := range hostsInFlake(f) {
+		if h.Name != activeHost {
+			continue
+		}
+		for _, m := range lists {
+			if m.List.Pos() >= h.Value.Pos() && m.List.End() <= h.Value.End() {
+				kept = append(kept, m)
+			}
+		}
+	}
+	return kept
+}
+
+// Lists bound to a block in a parsed file; in flake.nix only those
+// inside the active host's entry, as the other hosts' inline modules
+// don't belong to it
+func packageLists(path string, f *nix.File, blockName string) []nix.ListMatch {
+	lists := nix.FindLists(f, blockName)
+	if activeHost != "" && filepath.Base(path) == "flake.nix" {
+		return hostLists(f, lists)
+	}
+	return lists
+}
+
+// .nix files apm reads and edits: the whole flake, or only the modules
+// of the active host plus flake.nix for its inline modules
+func packageFiles(flakeDir string) ([]string, error) {
+	if activeHost == "" {
+		return ListFilePaths(flakeDir)
+	}
+	host, err := findHost(flakeDir, activeHost)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{filepath.Join(flakeDir, "flake.nix")}, host.Files...), nil
+}
+
+// Whether the flake only has homeConfigurations, i.e. Home Manager is
+// used on its own rather than as a NixOS module
+func standaloneHome(flakeDir string) bool {
+	f, err := parseNixFile(filepath.Join(flakeDir, "flake.nix"))
+	if err != nil {
+		return false
+	}
+	hosts := hostsInFlake(f)
+	if len(hosts) == 0 {
+		return false
+	}
+	for _, h := range hosts {
+		if !h.Home {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether new modules go into a homeConfigurations entry: the active
+// host is one, or the flake has nothing else
+func homeTarget(flakeDir string) bool {
+	if activeHost == "" {
+		return standaloneHome(flakeDir)
+	}
+	host, err := findHost(flakeDir, activeHost)
+	return err == nil && host.Home
+}
+
+// Command run in the flake, as root unless it is for a Home Manager
+// configuration and so belongs to the user: the active host is a
+// homeConfigurations entry, or without one the flake has nothing else.
+// rebuildCommand decides the same way.
+func flakeCommand(flakeDir, name string, args ...string) *exec.Cmd {
+	var cmd *exec.Cmd
+	if homeTarget(flakeDir) {
+		cmd = exec.Command(name, args...)
+	} else {
+		cmd = privileged(name, args...)
+	}
+	cmd.Dir = flakeDir
+	return cmd
+}
+
+// Command applying the configuration: home-manager switch for
+// homeConfigurations, which needs no root, otherwise nixos-rebuild
+func rebuildCommand(flakeDir string) (*exec.Cmd, error) {
+	if activeHost == "" {
+		if !standaloneHome(flakeDir) {
+			return privileged("nixos-rebuild", "switch", "--flake", flakeDir), nil
+		}
+		name, err := homeConfigName(flakeDir)
+		if err != nil {
+			return nil, err
+		}
+		return exec.Command("home-manager", "switch", "--flake", flakeDir+"#"+name), nil
+	}
+	host, err := findHost(flakeDir, activeHost)
+	if err != nil {
+		return nil, err
+	}
+	ref := flakeDir + "#" + host.Name
+	if host.Home {
+		return exec.Command("home-manager", "switch", "--flake", ref), nil
+	}
+	return privileged("nixos-rebuild", "switch", "--flake", ref), nil
+}
+
+// homeConfigurations entry to switch to without --host: the only one,
+// otherwise $USER@hostname, then $USER
+func homeConfigName(flakeDir string) (string, error) {
+	hosts, err := flakeHosts(flakeDir)
+	if err != nil {
+		return "", err
+	}
+	var names []string
+	for _, h := range hosts {
+		if h.Home {
+			names = append(names, h.Name)
+		}
+	}
+	if len(names) == 1 {
+		return names[0], nil
+	}
+
+	username := os.Getenv("USER")
+	if u, err := user.Current(); username == "" && err == nil {
+		username = u.Username
+	}
+	var candidates []string
+	if hostname, err := os.Hostname(); err == nil && username != "" {
+		short, _, _ := strings.Cut(hostname, ".")
+		candidates = append(candidates, username+"@"+short)
+		if short != hostname {
+			candidates = append(candidates, username+"@"+hostname)
+		}
+	}
+	if username != "" {
+		candidates = append(candidates, username)
+	}
+	for _, c := range candidates {
+		if contains(names, c) {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("no homeConfigurations entry matches %s (available: %s); pick one with --host", strings.Join(candidates, " or "), strings.Join(names, ", "))
+}
+
+// Print the hosts of the flake and their module files
+func listHosts(flakeDir string) error {
+	hosts, err := flakeHosts(flakeDir)
+	if err != nil {
+		return err
+	}
+	if len(hosts) == 0 {
+		fmt.Println("No nixosConfigurations or homeConfigurations found in flake.nix")
+		return nil
+	}
+	for _, h := range hosts {
+		marker := " "
+		if h.Name == activeHost {
+			marker = "*"
+		}
+		kind := "nixos"
+		if h.Home {
+			kind = "home-manager"
+		}
+		fmt.Printf("%s %s (%s)\n", marker, h.Name, kind)
+		for _, file := range h.Files {
+			if rel, err := filepath.Rel(flakeDir, file); err == nil {
+				file = rel
+			}
+			fmt.Printf("    %s\n", file)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const mixedFlake = `{
+  outputs = { nixpkgs, home-manager, ... }: {
+    nixosConfigurations.laptop = nixpkgs.lib.nixosSystem {
+      modules = [ ./laptop.nix ];
+    };
+    homeConfigurations."alice@laptop" = home-manager.lib.homeManagerConfiguration {
+      modules = [ ./home.nix ];
+    };
+  };
+}
+`
+
+const standaloneFlake = `{
+  outputs = { home-manager, ... }: {
+    homeConfigurations."alice@laptop" = home-manager.lib.homeManagerConfiguration {
+      modules = [ ./home.nix ];
+    };
+  };
+}
+`
+
+func testFlake(t *testing.T, flake string) string {
+	t.Helper()
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "flake.nix"), flake)
+	return dir
+}
+
+func TestFlakeAndRebuildCommands(t *testing.T) {
+	testEnv(t)
+	settings.Sudo = "sudo"
+	t.Setenv("USER", "alice")
+
+	tests := []struct {
+		name    string
+		flake   string
+		host    string
+		sudo    bool
+		rebuild string
+	}{
+		{"mixed flake", mixedFlake, "", true, "nixos-rebuild switch --flake %s"},
+		{"mixed flake, nixos host", mixedFlake, "laptop", true, "nixos-rebuild switch --flake %s#laptop"},
+		{"mixed flake, home host", mixedFlake, "alice@laptop", false, "home-manager switch --flake %s#alice@laptop"},
+		{"standalone", standaloneFlake, "", false, "home-manager switch --flake %s#alice@laptop"},
+		{"standalone, explicit host", standaloneFlake, "alice@laptop", false, "home-manager switch --flake %s#alice@laptop"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := testFlake(t, tt.flake)
+			activeHost = tt.host
+
+			update := flakeCommand(dir, "nix", "flake", "update")
+			if got := update.Args[0] == "sudo"; got != tt.sudo {
+				t.Errorf("flake update runs %q, want sudo %v", update.Args, tt.sudo)
+			}
+			if update.Dir != dir {
+				t.Errorf("flake update runs in %s", update.Dir)
+			}
+
+			rebuild, err := rebuildCommand(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := strings.ReplaceAll(tt.rebuild, "%s", dir)
+			if tt.sudo {
+				want = "sudo " + want
+			}
+			if got := strings.Join(rebuild.Args, " "); got != want {
+				t.Errorf("rebuild runs %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestUnknownHost(t *testing.T) {
+	testEnv(t)
+	dir := testFlake(t, mixedFlake)
+	activeHost = "server"
+	_, err := rebuildCommand(dir)
+	if err == nil || !strings.Contains(err.Error(), "laptop, alice@laptop") {
+		t.Errorf("got %v, want an error listing the hosts", err)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	cache "alloylinux/apm/src/database"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Platforms listed before the rest are only counted
+const infoMaxPlatforms = 8
+
+// Print everything the caches know about a package, and where it is installed
+func showPackageInfo(query, flakeDir string) error {
+	channels, err := cache.CachedChannels()
+	if err != nil {
+		return err
+	}
+	if len(channels) == 0 {
+		return cache.MissingCacheError(cache.DefaultChannel)
+	}
+
+	attr, err := findInfoAttr(query, channels)
+	if err != nil {
+		return err
+	}
+
+	// The package as each cached channel has it
+	var shown *cache.PackageInfo
+	var versions []string
+	for _, ch := range channels {
+		db, err := cache.Open(ch)
+		if err != nil {
+			fmt.Printf("Warning: %v\n", err)
+			continue
+		}
+		pkg, err := db.Package(attr)
+		db.Close()
+		if err != nil || pkg == nil {
+			continue
+		}
+		if shown == nil || ch == cache.DefaultChannel {
+			shown = pkg
+		}
+		versions = append(versions, fmt.Sprintf("%s (%s)", pkg.Version, ch))
+	}
+	if shown == nil {
+		return fmt.Errorf("package '%s' not found in any cache", attr)
+	}
+
+	fmt.Println(attr)
+	infoField("Name", shown.Pname)
+	infoField("Version", strings.Join(versions, ", "))
+	infoField("Description", shown.Description)
+	infoField("License", shown.License)
+	infoField("Homepage", shown.Homepage)
+	infoField("Main program", shown.MainProgram)
+	infoField("Platforms", summarizePlatforms(shown.Platforms))
+	if w := shown.Warnings(hostSystem()); len(w) > 0 {
+		infoField("Warnings", strings.Join(w, ", "))
+	}
+	if shown.LongDescription != "" {
+		fmt.Println()
+		for _, line := range strings.Split(shown.LongDescription, "\n") {
+			fmt.Printf("  %s\n", strings.TrimRight(line, " "))
+		}
+	}
+
+	fmt.Println()
+	printInstallLocations(flakeDir, attr, []InstallationMethod{NixEnv, HomeManager})
+	return nil
+}
+
+// Attribute path to show: the query itself when a cache has it,
+// otherwise the best search match
+func findInfoAttr(query string, channels []string) (string, error) {
+	for _, ch := range channels {
+		db, err := cache.Open(ch)
+		if err != nil {
+			continue
+		}
+		pkg, err := db.Package(query)
+		db.Close()
+		if err == nil && pkg != nil {
+			return query, nil
+		}
+	}
+	// nixpkgs comes first when it is cached
+	return resolvePackage(query, NixEnv, false, channels[0])
+}
+
+// Print the entries installing a package, with file and line
+func printInstallLocations(flakeDir, name string, methods []InstallationMethod) {
+	if flakeDir == "" {
+		return
+	}
+	found := false
+	var listErr error
+	for _, method := range methods {
+		entries, err := listBlockEntries(flakeDir, method)
+		if err != nil {
+			listErr = err
+			continue
+		}
+		for _, e := range entries {
+			if !entryMatches(e.Normalized(), name, method) {
+				continue
+			}
+			if !found {
+				fmt.Println("Installed:")
+				found = true
+			}
+			fmt.Printf("  %-13s %s:%d  %s\n", methodFlagName(method), e.File, e.Line, e.Text)
+		}
+	}
+	switch {
+	case found:
+	case listErr != nil:
+		// Only "not installed" when the files could be read
+		fmt.Printf("Install location unknown: %v\n", listErr)
+	default:
+		fmt.Println("Not installed")
+	}
+}
+
+// First few platforms and how many more there are
+func summarizePlatforms(platforms string) string {
+	list := strings.Fields(platforms)
+	if len(list) == 0 {
+		return ""
+	}
+	if len(list) <= infoMaxPlatforms {
+		return strings.Join(list, " ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(list[:infoMaxPlatforms], " "), len(list)-infoMaxPlatforms)
+}
+
+// Labelled line, skipped when empty
+func infoField(label, value string) {
+	if value == "" {
+		return
+	}
+	fmt.Printf("  %-13s %s\n", label+":", value)
+}
+
+// App details from the Flathub API
+type flathubApp struct {
+	FlatpakAppId          string `json:"flatpakAppId"`
+	Name                  string `json:"name"`
+	Summary               string `json:"summary"`
+	Description           string `json:"description"`
+	DeveloperName         string `json:"developerName"`
+	ProjectLicense        string `json:"projectLicense"`
+	HomepageUrl           string `json:"homepageUrl"`
+	BugtrackerUrl         string `json:"bugtrackerUrl"`
+	CurrentReleaseVersion string `json:"currentReleaseVersion"`
+	CurrentReleaseDate    string `json:"currentReleaseDate"`
+}
+
+func fetchFlathubApp(appID string) (*flathubApp, error) {
+	url := fmt.Sprintf("https://flathub.org/api/v1/apps/%s", appID)
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Flathub API error: %s", resp.Status)
+	}
+	var app flathubApp
+	if err := json.NewDecoder(resp.Body).Decode(&app); err != nil {
+		return nil, err
+	}
+	if app.FlatpakAppId == "" {
+		return nil, errors.New("flatpak not found")
+	}
+	return &app, nil
+}
+
+var (
+	htmlTagPattern   = regexp.MustCompile(`<[^>]*>`)
+	htmlBlockPattern = regexp.MustCompile(`</(p|li)>`)
+)
+
+// Print a Flathub app's metadata, and where it is installed
+func showFlatpakInfo(query, flakeDir string) error {
+	appID := query
+	// Without dots it is a search term, as in add
+	if !strings.Contains(appID, ".") {
+		results, err := searchFlathub(query)
+		if err != nil {
+			return err
+		}
+		if len(results) == 0 {
+			return fmt.Errorf("no Flathub app matches '%s'", query)
+		}
+		appID = results[0].Pname
+	}
+	app, err := fetchFlathubApp(appID)
+	if err != nil {
+		return fmt.Errorf("%s: %v", appID, err)
+	}
+
+	fmt.Println(app.FlatpakAppId)
+	infoField("Name", app.Name)
+	version := app.CurrentReleaseVersion
+	if version != "" && app.CurrentReleaseDate != "" {
+		version += " (" + app.CurrentReleaseDate + ")"
+	}
+	infoField("Version", version)
+	infoField("Summary", app.Summary)
+	infoField("Developer", app.DeveloperName)
+	infoField("License", app.ProjectLicense)
+	infoField("Homepage", app.HomepageUrl)
+	infoField("Bug tracker", app.BugtrackerUrl)
+	if text := flathubText(app.Description); text != "" {
+		fmt.Println()
+		for _, line := range strings.Split(text, "\n") {
+			fmt.Printf("  %s\n", line)
+		}
+	}
+
+	fmt.Println()
+	printInstallLocations(flakeDir, app.FlatpakAppId, []InstallationMethod{Flatpak})
+	return nil
+}
+
+// Plain text of a Flathub description, one paragraph or item per line
+func flathubText(s string) string {
+	s = htmlBlockPattern.ReplaceAllString(strings.Join(strings.Fields(s), " "), "\n")
+	s = html.UnescapeString(htmlTagPattern.ReplaceAllString(s, ""))
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
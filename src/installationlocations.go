@@ -1,12 +1,12 @@
 package main
 
 import (
+	"alloylinux/apm/src/nix"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
@@ -50,273 +50,360 @@ var flatpakPackagesBoilerplate = `
 
 `
 
-// Check if a package configuration already exists in any .nix file
-func packageConfigExists(flakeDir, configType string) bool {
-	err := filepath.WalkDir(flakeDir, func(path string, d os.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if d.IsDir() || !strings.HasSuffix(d.Name(), ".nix") {
-			return nil
-		}
+// Package file created for each method, under packages/
+var packageFileNames = map[InstallationMethod]string{
+	HomeManager: "home-packages.nix",
+	NixEnv:      "environment-packages.nix",
+	Flatpak:     "flatpak-packages.nix",
+}
 
-		content, err := os.ReadFile(path)
-		if err != nil {
-			return nil // Skip files we can't read
-		}
+// Change to the flake needed before packages can be added, shown in
+// the install plan and run once it is confirmed
+type scaffoldStep struct {
+	Description string
+	Run         func() error
+}
 
-		if strings.Contains(string(content), configType) {
-			return fmt.Errorf("found")
+// Check if a package configuration already exists in any .nix file
+func packageConfigExists(flakeDir, configType string) bool {
+	files, err := packageFiles(flakeDir)
+	if err != nil {
+		return false
+	}
+	for _, path := range files {
+		if fileHasBlock(path, configType) {
+			return true
 		}
-
-		return nil
-	})
-
-	return err != nil && err.Error() == "found"
+	}
+	return false
 }
 
-// Create package configuration file if it doesn't exist
-func createPackageFile(flakeDir, filename, configType, boilerplate, modulePath string) {
-	// Check if package config already exists
+// Steps creating a package file and adding it as a module, none when the
+// configuration already has the block
+func packageFileSteps(flakeDir, filename, configType, boilerplate, modulePath string) ([]scaffoldStep, error) {
 	if packageConfigExists(flakeDir, configType) {
-		fmt.Printf("%s already exists in configuration, skipping creation\n", configType)
-		return
-	}
-
-	// Ask for confirmation
-	fmt.Printf("About to create file '%s' and add module '%s'\n", filename, modulePath)
-	fmt.Print("Proceed? [y/N]: ")
-	var response string
-	fmt.Scanln(&response)
-	if strings.ToLower(strings.TrimSpace(response)) != "y" {
-		fmt.Println("Operation cancelled.")
-		return
+		return nil, nil
 	}
-
-	// Create packages file
-	file, err := os.Create(filepath.Join(flakeDir, "packages", filename))
-	if err != nil {
-		log.Printf("Error creating %s: %v", filename, err)
-		return
+	path := filepath.Join(flakeDir, "packages", filename)
+	if _, err := changes.ReadFile(path); err == nil {
+		return nil, fmt.Errorf("%s exists but has no '%s' list; add one or pick a file with --file", relToFlake(flakeDir, path), configType)
 	}
-	defer file.Close()
-
-	// Write boilerplate content
-	_, err = file.WriteString(boilerplate)
+	steps := []scaffoldStep{{
+		Description: fmt.Sprintf("create %s", relToFlake(flakeDir, path)),
+		Run: func() error {
+			if err := changes.MkdirAll(filepath.Dir(path)); err != nil {
+				return fmt.Errorf("error creating directory %s: %v", filepath.Dir(path), err)
+			}
+			if err := changes.WriteFile(path, []byte(boilerplate)); err != nil {
+				return fmt.Errorf("error creating %s: %v", filename, err)
+			}
+			fmt.Printf("Created %s\n", path)
+			return nil
+		},
+	}}
+	step, err := moduleStep(filepath.Join(flakeDir, "flake.nix"), modulePath)
 	if err != nil {
-		log.Printf("Error writing to %s: %v", filename, err)
-		return
+		return nil, fmt.Errorf("error adding module to flake: %v", err)
 	}
-
-	// Add module to flake
-	err = addModule(filepath.Join(flakeDir, "flake.nix"), modulePath)
-	if err != nil {
-		log.Printf("Error adding module to flake: %v", err)
+	if step != nil {
+		steps = append(steps, *step)
 	}
+	return steps, nil
 }
 
-func setupHomeManagerPackages() {
-	homedir, err := os.UserHomeDir()
+// Steps setting up Home Manager: its input, its NixOS module and the
+// packages file
+func homeEnvSteps(flakeDir string) ([]scaffoldStep, error) {
+	var steps []scaffoldStep
+	flakePath := filepath.Join(flakeDir, "flake.nix")
+	input, err := inputStep(flakePath, "home-manager", "")
 	if err != nil {
-		log.Printf("Error getting home directory: %v", err)
-		return
+		return nil, fmt.Errorf("error adding home-manager input to flake: %v", err)
+	}
+	if input != nil {
+		steps = append(steps, *input)
 	}
 
-	flakeLocationPath := filepath.Join(homedir, ".config", "apm", "flakelocation.txt")
-
-	flakeDir, err := readFlakeLocation(flakeLocationPath)
-	if err != nil {
-		log.Printf("Error reading flake location: %v", err)
-		return
+	// Standalone configurations are Home Manager modules already
+	if !homeTarget(flakeDir) {
+		module, err := moduleStep(flakePath, "inputs.home-manager.nixosModules.home-manager")
+		if err != nil {
+			return nil, fmt.Errorf("error adding home-manager module to flake: %v", err)
+		}
+		if module != nil {
+			steps = append(steps, *module)
+		}
 	}
 
-	// Add home-manager input to flake
-	err = addInput(filepath.Join(flakeDir, "flake.nix"), "home-manager", "")
+	files, err := packageFileSteps(flakeDir, packageFileNames[HomeManager], "home.packages", homeManagerBoilerplate, "./packages/"+packageFileNames[HomeManager])
 	if err != nil {
-		log.Printf("Error adding home-manager input to flake: %v", err)
-		return
+		return nil, err
 	}
-
-	// Add home-manager module to flake
-	addModule(filepath.Join(flakeDir, "flake.nix"), "inputs.home-manager.nixosModules.home-manager")
+	return append(steps, files...), nil
 }
 
-func makeNixEnv() {
-	homedir, err := os.UserHomeDir()
+// Steps creating the system packages file
+func nixEnvSteps(flakeDir string) ([]scaffoldStep, error) {
+	// Check if flake.nix exists
+	_, err := changes.ReadFile(filepath.Join(flakeDir, "flake.nix"))
 	if err != nil {
-		log.Printf("Error getting home directory: %v", err)
-		return
+		return nil, fmt.Errorf("error reading flake.nix: %v (is your system flaked?)", err)
 	}
-
-	flakeLocationPath := filepath.Join(homedir, ".config", "apm", "flakelocation.txt")
-
-	flakeDir, err := readFlakeLocation(flakeLocationPath)
-	if err != nil {
-		log.Printf("Error reading flake location: %v", err)
-		return
+	if homeTarget(flakeDir) {
+		return nil, fmt.Errorf("environment.systemPackages needs a NixOS configuration; this is a standalone Home Manager configuration, use --home-manager")
 	}
+	return packageFileSteps(flakeDir, packageFileNames[NixEnv], "environment.systemPackages", systemPackagesBoilerplate, "./packages/"+packageFileNames[NixEnv])
+}
 
-	err = os.MkdirAll(filepath.Join(flakeDir, "packages"), 0o755)
-	if err != nil {
-		log.Printf("Error creating directory %s: %v", filepath.Join(flakeDir, "packages"), err)
-		return
+// Step adding the Flatpak module, the Home Manager one for standalone
+// setups
+func flatpakModuleStep(flakeDir string) (*scaffoldStep, error) {
+	module := "flatpaks.nixosModules.nix-flatpak"
+	if homeTarget(flakeDir) {
+		module = "flatpaks.homeManagerModules.nix-flatpak"
 	}
-
-	// Check if flake.nix exists
-	_, err = os.ReadFile(filepath.Join(flakeDir, "flake.nix"))
+	step, err := moduleStep(filepath.Join(flakeDir, "flake.nix"), module)
 	if err != nil {
-		log.Printf("Error reading flake.nix: %v (is your system flaked?)", err)
-		return
+		return nil, fmt.Errorf("error adding Flatpak module to flake: %v", err)
 	}
-
-	// Create system packages file
-	createPackageFile(flakeDir, "environment-packages.nix", "environment.systemPackages", systemPackagesBoilerplate, "./packages/environment-packages.nix")
+	return step, nil
 }
 
-func addModule(flakePath, modulePath string) error {
-	// Read flake.nix
-	content, err := os.ReadFile(flakePath)
+// Steps adding the Flatpak module and the Flatpak packages file
+func flatpakSteps(flakeDir string) ([]scaffoldStep, error) {
+	var steps []scaffoldStep
+	step, err := flatpakModuleStep(flakeDir)
 	if err != nil {
-		return fmt.Errorf("error reading flake.nix: %v", err)
+		return nil, err
+	}
+	if step != nil {
+		steps = append(steps, *step)
+	}
+	files, err := packageFileSteps(flakeDir, packageFileNames[Flatpak], "services.flatpak.packages", flatpakPackagesBoilerplate, "./packages/"+packageFileNames[Flatpak])
+	if err != nil {
+		return nil, err
 	}
+	return append(steps, files...), nil
+}
 
-	// Check if module already exists
-	if strings.Contains(string(content), modulePath) {
-		fmt.Printf("Module '%s' already exists in flake\n", modulePath)
+// Show the steps, ask once and run them
+func applySteps(steps []scaffoldStep) error {
+	if len(steps) == 0 {
+		fmt.Println("Nothing to do, the flake is already set up.")
 		return nil
 	}
-
-	// Ask for confirmation
-	fmt.Printf("About to add module '%s' to flake\n", modulePath)
-	fmt.Print("Proceed? [y/N]: ")
-	var response string
-	fmt.Scanln(&response)
-	if strings.ToLower(strings.TrimSpace(response)) != "y" {
+	fmt.Println("About to:")
+	for _, step := range steps {
+		fmt.Printf("  * %s\n", step.Description)
+	}
+	ok, err := prompter.Confirm("Proceed?", false)
+	if err != nil {
+		return err
+	}
+	if !ok {
 		fmt.Println("Operation cancelled.")
 		return nil
 	}
-
-	// Find modules array
-	contentStr := string(content)
-	modulesIndex := strings.Index(contentStr, "modules = [")
-	if modulesIndex == -1 {
-		return fmt.Errorf("modules array not found in flake.nix")
+	for _, step := range steps {
+		if err := step.Run(); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	// Find closing bracket
-	closeIndex := strings.Index(contentStr[modulesIndex:], "]")
-	if closeIndex == -1 {
-		return fmt.Errorf("closing bracket not found for modules array")
+// Create the system packages file
+func makeNixEnv() error {
+	flakeDir, err := configuredFlakeDir()
+	if err != nil {
+		return fmt.Errorf("error reading flake location: %v", err)
 	}
-	closeIndex += modulesIndex
-
-	// Insert module before closing bracket
-	newContent := contentStr[:closeIndex] + "    " + modulePath + "\n" + contentStr[closeIndex:]
-
-	// Write back
-	err = os.WriteFile(flakePath, []byte(newContent), 0644)
+	steps, err := nixEnvSteps(flakeDir)
 	if err != nil {
-		return fmt.Errorf("error writing flake.nix: %v", err)
+		return err
 	}
-
-	fmt.Printf("Added module '%s' to flake\n", modulePath)
-	return nil
+	return applySteps(steps)
 }
 
 // Create home manager packages file
-func makeHomeEnv() {
-	homedir, err := os.UserHomeDir()
+func makeHomeEnv() error {
+	flakeDir, err := configuredFlakeDir()
 	if err != nil {
-		log.Printf("Error getting home directory: %v", err)
-		return
+		return fmt.Errorf("error reading flake location: %v", err)
 	}
-
-	flakeLocationPath := filepath.Join(homedir, ".config", "apm", "flakelocation.txt")
-
-	flakeDir, err := readFlakeLocation(flakeLocationPath)
+	steps, err := homeEnvSteps(flakeDir)
 	if err != nil {
-		log.Printf("Error reading flake location: %v", err)
-		return
+		return err
 	}
+	return applySteps(steps)
+}
 
-	err = os.MkdirAll(filepath.Join(flakeDir, "packages"), 0o755)
+// Setup Flatpak module
+func setupFlatpak() error {
+	flakeDir, err := configuredFlakeDir()
 	if err != nil {
-		log.Printf("Error creating directory %s: %v", filepath.Join(flakeDir, "packages"), err)
-		return
+		return fmt.Errorf("error reading flake location: %v", err)
 	}
+	step, err := flatpakModuleStep(flakeDir)
+	if err != nil {
+		return err
+	}
+	var steps []scaffoldStep
+	if step != nil {
+		steps = append(steps, *step)
+	}
+	return applySteps(steps)
+}
 
-	// Setup home-manager input and module
-	setupHomeManagerPackages()
-
-	// Create home manager packages file
-	createPackageFile(flakeDir, "home-packages.nix", "home.packages", homeManagerBoilerplate, "./packages/home-packages.nix")
+// Modules arrays a new module can go into, only the active host's if one
+// is picked
+func moduleLists(flake *nix.File) ([]nix.ListMatch, error) {
+	lists := nix.FindLists(flake, "modules")
+	if activeHost != "" {
+		lists = hostLists(flake, lists)
+		if len(lists) == 0 {
+			return nil, fmt.Errorf("modules array of host '%s' not found in flake.nix", activeHost)
+		}
+	}
+	if len(lists) == 0 {
+		return nil, fmt.Errorf("modules array not found in flake.nix")
+	}
+	return lists, nil
 }
 
-// Setup Flatpak module
-func setupFlatpak() {
-	homedir, err := os.UserHomeDir()
+// Step adding a module to flake.nix, nil when it is already there
+func moduleStep(flakePath, modulePath string) (*scaffoldStep, error) {
+	flake, err := parseNixFile(flakePath)
 	if err != nil {
-		log.Printf("Error getting home directory: %v", err)
-		return
+		return nil, fmt.Errorf("error reading flake.nix: %v", err)
+	}
+	lists, err := moduleLists(flake)
+	if err != nil {
+		return nil, err
+	}
+	if moduleInLists(flake, lists, modulePath) {
+		return nil, nil
 	}
+	return &scaffoldStep{
+		Description: fmt.Sprintf("add module '%s' to flake.nix", modulePath),
+		Run:         func() error { return addModule(flakePath, modulePath) },
+	}, nil
+}
 
-	flakeLocationPath := filepath.Join(homedir, ".config", "apm", "flakelocation.txt")
+func moduleInLists(flake *nix.File, lists []nix.ListMatch, modulePath string) bool {
+	for _, m := range lists {
+		for _, elem := range m.List.Elems {
+			if flake.Text(elem) == modulePath {
+				return true
+			}
+		}
+	}
+	return false
+}
 
-	flakeDir, err := readFlakeLocation(flakeLocationPath)
+// Add a module to flake.nix. Steps before it may have edited the file,
+// so it is read again.
+func addModule(flakePath, modulePath string) error {
+	// Read flake.nix
+	flake, err := parseNixFile(flakePath)
+	if err != nil {
+		return fmt.Errorf("error reading flake.nix: %v", err)
+	}
+	lists, err := moduleLists(flake)
 	if err != nil {
-		log.Printf("Error reading flake location: %v", err)
-		return
+		return err
+	}
+	if moduleInLists(flake, lists, modulePath) {
+		return nil
+	}
+
+	// Prefer the unconditional list
+	target := lists[0]
+	for _, m := range lists {
+		if !m.Conditional {
+			target = m
+			break
+		}
 	}
+	rw := nix.NewRewriter(flake)
+	rw.AppendToList(target.List, modulePath)
 
-	// Add Flatpak module to flake
-	err = addModule(filepath.Join(flakeDir, "flake.nix"), "flatpaks.nixosModules.nix-flatpak")
+	// Write back
+	out, err := rw.Bytes()
 	if err != nil {
-		log.Printf("Error adding Flatpak module to flake: %v", err)
+		return fmt.Errorf("error editing flake.nix: %v", err)
 	}
+	err = changes.WriteFile(flakePath, out)
+	if err != nil {
+		return fmt.Errorf("error writing flake.nix: %v", err)
+	}
+
+	fmt.Printf("Added module '%s' to flake\n", modulePath)
+	return nil
 }
 
 // Extract nixpkgs version from flake
 func getNixpkgsVersion(flakePath string) (string, error) {
 	// Read flake.nix
-	content, err := os.ReadFile(flakePath)
+	flake, err := parseNixFile(flakePath)
 	if err != nil {
 		return "", fmt.Errorf("error reading flake.nix: %v", err)
 	}
 
-	contentStr := string(content)
-
-	// Find nixpkgs.url line
-	lines := strings.Split(contentStr, "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.Contains(line, "nixpkgs.url =") && !strings.HasPrefix(line, "#") {
-			// Extract version from URL
-			if strings.Contains(line, "nixos-") {
-				parts := strings.Split(line, "nixos-")
-				if len(parts) == 2 {
-					version := strings.Split(parts[1], "\"")[0]
-					return version, nil
-				}
+	// Extract version from the nixpkgs URL
+	inputs, _, _ := flakeInputs(flake)
+	if in := findInput(inputs, "nixpkgs"); in != nil {
+		if idx := strings.Index(in.URL, "nixos-"); idx != -1 {
+			version := in.URL[idx+len("nixos-"):]
+			if slash := strings.IndexAny(version, "/?"); slash != -1 {
+				version = version[:slash]
 			}
+			return version, nil
 		}
 	}
 
 	return "", fmt.Errorf("nixpkgs version not found in flake")
 }
 
+// Add an input to flake.nix after asking
 func addInput(flakePath, inputName, inputURL string) error {
-	// Read flake.nix
-	content, err := os.ReadFile(flakePath)
+	step, err := inputStep(flakePath, inputName, inputURL)
 	if err != nil {
-		return fmt.Errorf("error reading flake.nix: %v", err)
+		return err
 	}
+	if step == nil {
+		fmt.Printf("Input '%s' already exists in flake\n", inputName)
+		return nil
+	}
+
+	// Ask for confirmation
+	fmt.Printf("About to %s\n", step.Description)
+	ok, err := prompter.Confirm("Proceed?", false)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fmt.Println("Operation cancelled.")
+		return nil
+	}
+	return step.Run()
+}
 
-	contentStr := string(content)
+// Step adding an input to flake.nix, nil when it already exists
+func inputStep(flakePath, inputName, inputURL string) (*scaffoldStep, error) {
+	// Read flake.nix
+	flake, err := parseNixFile(flakePath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading flake.nix: %v", err)
+	}
 
 	// Check if input already exists
-	if strings.Contains(contentStr, inputName+".url") {
-		fmt.Printf("Input '%s' already exists in flake\n", inputName)
-		return nil
+	inputs, inputsSet, lastInputsAttr := flakeInputs(flake)
+	if in := findInput(inputs, inputName); in != nil && in.URL != "" {
+		return nil, nil
+	}
+	if inputsSet == nil && lastInputsAttr == nil {
+		return nil, fmt.Errorf("inputs section not found in flake.nix")
 	}
 
 	// Handle special cases
@@ -335,7 +422,7 @@ func addInput(flakePath, inputName, inputURL string) error {
 			finalURL = fmt.Sprintf("github:nix-community/home-manager/release-%s", nixpkgsVersion)
 		}
 		// Add follows relationship
-		additionalLines = append(additionalLines, fmt.Sprintf("    %s.inputs.nixpkgs.follows = \"nixpkgs\";", inputName))
+		additionalLines = append(additionalLines, fmt.Sprintf("%s.inputs.nixpkgs.follows = \"nixpkgs\";", nix.QuoteAttr(inputName)))
 
 	case "flatpaks", "flatpak":
 		finalURL = "github:gmodena/nix-flatpak/?ref=latest"
@@ -344,131 +431,79 @@ func addInput(flakePath, inputName, inputURL string) error {
 		finalURL = inputURL
 	}
 
-	// Show what will be added
-	fmt.Printf("About to add input '%s' with URL '%s'\n", inputName, finalURL)
-	for _, line := range additionalLines {
-		fmt.Printf("Will also add: %s\n", strings.TrimSpace(line))
-	}
-
-	// Ask for confirmation
-	fmt.Print("Proceed? [y/N]: ")
-	var response string
-	fmt.Scanln(&response)
-	if strings.ToLower(strings.TrimSpace(response)) != "y" {
-		fmt.Println("Operation cancelled.")
-		return nil
+	description := fmt.Sprintf("add input '%s' with URL '%s'", inputName, finalURL)
+	if len(additionalLines) > 0 {
+		description += fmt.Sprintf(" (also %s)", strings.Join(additionalLines, " "))
 	}
+	lines := append([]string{fmt.Sprintf("%s.url = \"%s\";", nix.QuoteAttr(inputName), nix.Escape(finalURL))}, additionalLines...)
+	return &scaffoldStep{
+		Description: description,
+		Run:         func() error { return writeInput(flakePath, lines) },
+	}, nil
+}
 
-	// Find inputs section
-	inputsIndex := strings.Index(contentStr, "inputs = {")
-	if inputsIndex == -1 {
-		return fmt.Errorf("inputs section not found in flake.nix")
+// Add input bindings to the inputs section, or next to top-level
+// inputs.* bindings. Steps before it may have edited the file, so it is
+// read again.
+func writeInput(flakePath string, lines []string) error {
+	flake, err := parseNixFile(flakePath)
+	if err != nil {
+		return fmt.Errorf("error reading flake.nix: %v", err)
 	}
+	_, inputsSet, lastInputsAttr := flakeInputs(flake)
 
-	// Find the closing brace of inputs
-	braceCount := 0
-	closeIndex := inputsIndex + 9 // Start after "inputs = {"
-	for i := closeIndex; i < len(contentStr); i++ {
-		if contentStr[i] == '{' {
-			braceCount++
-		} else if contentStr[i] == '}' {
-			braceCount--
-			if braceCount == 0 {
-				closeIndex = i
-				break
-			}
+	rw := nix.NewRewriter(flake)
+	switch {
+	case inputsSet != nil:
+		rw.AppendBindings(inputsSet, lines...)
+	case lastInputsAttr != nil:
+		prefixed := make([]string, len(lines))
+		for i, line := range lines {
+			prefixed[i] = "inputs." + line
 		}
+		rw.InsertBindingsAfter(lastInputsAttr, prefixed...)
+	default:
+		return fmt.Errorf("inputs section not found in flake.nix")
 	}
 
-	if braceCount != 0 {
-		return fmt.Errorf("could not find closing brace for inputs section")
-	}
-
-	// Insert input before closing brace
-	newContent := contentStr[:closeIndex] + fmt.Sprintf("    %s.url = \"%s\";\n", inputName, finalURL)
-
-	// Add any additional lines (like follows)
-	for _, line := range additionalLines {
-		newContent += line + "\n"
-	}
-
-	newContent += contentStr[closeIndex:]
-
 	// Write back
-	err = os.WriteFile(flakePath, []byte(newContent), 0644)
+	out, err := rw.Bytes()
+	if err != nil {
+		return fmt.Errorf("error editing flake.nix: %v", err)
+	}
+	err = changes.WriteFile(flakePath, out)
 	if err != nil {
 		return fmt.Errorf("error writing flake.nix: %v", err)
 	}
 
-	fmt.Printf("Added input '%s' with URL '%s' to flake\n", inputName, finalURL)
-	for _, line := range additionalLines {
-		fmt.Printf("Added: %s\n", line)
+	for _, line := range lines {
+		fmt.Printf("Added %s to flake\n", line)
 	}
-
 	return nil
 }
 
 // Extract and list all inputs from flake.nix
 func listInputs(flakePath string) error {
 	// Read flake.nix
-	content, err := os.ReadFile(flakePath)
+	flake, err := parseNixFile(flakePath)
 	if err != nil {
 		return fmt.Errorf("error reading flake.nix: %v", err)
 	}
 
-	contentStr := string(content)
-
-	// Find inputs section
-	inputsIndex := strings.Index(contentStr, "inputs = {")
-	if inputsIndex == -1 {
+	inputs, _, _ := flakeInputs(flake)
+	if len(inputs) == 0 {
 		return fmt.Errorf("inputs section not found in flake.nix")
 	}
 
-	// Find the closing brace of inputs
-	braceCount := 0
-	closeIndex := inputsIndex + 9 // Start after "inputs = {"
-	for i := closeIndex; i < len(contentStr); i++ {
-		if contentStr[i] == '{' {
-			braceCount++
-		} else if contentStr[i] == '}' {
-			braceCount--
-			if braceCount == 0 {
-				closeIndex = i
-				break
-			}
-		}
-	}
-
-	if braceCount != 0 {
-		return fmt.Errorf("could not find closing brace for inputs section")
-	}
-
-	// Extract inputs section
-	inputsSection := contentStr[inputsIndex : closeIndex+1]
-
 	fmt.Println("Flake Inputs:")
 	fmt.Println("================")
 
-	// Parse inputs
-	lines := strings.Split(inputsSection, "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.Contains(line, ".url =") && !strings.HasPrefix(line, "#") {
-			// Extract input name and URL
-			parts := strings.Split(line, ".url =")
-			if len(parts) == 2 {
-				inputName := strings.TrimSpace(parts[0])
-				inputURL := strings.Trim(strings.TrimSpace(parts[1]), "\";")
-				fmt.Printf("- %s -> %s\n", inputName, inputURL)
-			}
-		} else if strings.Contains(line, ".follows =") && !strings.HasPrefix(line, "#") {
-			// Handle follows
-			parts := strings.Split(line, ".follows =")
-			if len(parts) == 2 {
-				inputName := strings.TrimSpace(parts[0])
-				follows := strings.Trim(strings.TrimSpace(parts[1]), "\";")
-				fmt.Printf("- %s -> follows %s\n", inputName, follows)
-			}
+	for _, in := range inputs {
+		if in.URL != "" {
+			fmt.Printf("- %s -> %s\n", in.Name, in.URL)
+		}
+		for _, f := range in.Follows {
+			fmt.Printf("- %s -> follows %s\n", f[0], f[1])
 		}
 	}
 
@@ -478,73 +513,44 @@ func listInputs(flakePath string) error {
 // Extract modules from inputs (for inputs that have modules)
 func extractInputModules(flakePath string) error {
 	// Read flake.nix
-	content, err := os.ReadFile(flakePath)
+	flake, err := parseNixFile(flakePath)
 	if err != nil {
 		return fmt.Errorf("error reading flake.nix: %v", err)
 	}
 
-	contentStr := string(content)
-
 	fmt.Println("Available Input Modules:")
 	fmt.Println("===========================")
 
-	// Find inputs section
-	inputsIndex := strings.Index(contentStr, "inputs = {")
-	if inputsIndex == -1 {
+	inputs, _, _ := flakeInputs(flake)
+	if len(inputs) == 0 {
 		return fmt.Errorf("inputs section not found in flake.nix")
 	}
 
-	// Find the closing brace of inputs
-	braceCount := 0
-	closeIndex := inputsIndex + 9 // Start after "inputs = {"
-	for i := closeIndex; i < len(contentStr); i++ {
-		if contentStr[i] == '{' {
-			braceCount++
-		} else if contentStr[i] == '}' {
-			braceCount--
-			if braceCount == 0 {
-				closeIndex = i
-				break
-			}
+	// Suggest modules for each input
+	for _, in := range inputs {
+		if in.URL == "" {
+			continue
 		}
-	}
-
-	if braceCount != 0 {
-		return fmt.Errorf("could not find closing brace for inputs section")
-	}
-
-	// Extract inputs section
-	inputsSection := contentStr[inputsIndex : closeIndex+1]
-
-	// Parse inputs and suggest modules
-	lines := strings.Split(inputsSection, "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.Contains(line, ".url =") && !strings.HasPrefix(line, "#") {
-			parts := strings.Split(line, ".url =")
-			if len(parts) == 2 {
-				inputName := strings.TrimSpace(parts[0])
-				inputURL := strings.Trim(strings.TrimSpace(parts[1]), "\";")
-
-				// Suggest common module patterns
-				if strings.Contains(inputURL, "home-manager") {
-					fmt.Printf("- %s.nixosModules.home-manager\n", inputName)
-					fmt.Printf("- %s.homeManagerModules.default\n", inputName)
-				} else if strings.Contains(inputURL, "flatpak") || strings.Contains(inputURL, "nix-flatpak") {
-					fmt.Printf("- %s.nixosModules.nix-flatpak\n", inputName)
-					fmt.Printf("- %s.homeManagerModules.nix-flatpak\n", inputName)
-				} else if strings.Contains(inputURL, "hyprland") {
-					fmt.Printf("- %s.nixosModules.default\n", inputName)
-					fmt.Printf("- %s.homeManagerModules.default\n", inputName)
-				} else if strings.Contains(inputURL, "spicetify") {
-					fmt.Printf("- %s.nixosModules.default\n", inputName)
-					fmt.Printf("- %s.homeManagerModules.default\n", inputName)
-				} else {
-					// Generic suggestions
-					fmt.Printf("- %s.nixosModules.default\n", inputName)
-					fmt.Printf("- %s.homeManagerModules.default\n", inputName)
-				}
-			}
+		inputName := in.Name
+		inputURL := in.URL
+
+		// Suggest common module patterns
+		if strings.Contains(inputURL, "home-manager") {
+			fmt.Printf("- %s.nixosModules.home-manager\n", inputName)
+			fmt.Printf("- %s.homeManagerModules.default\n", inputName)
+		} else if strings.Contains(inputURL, "flatpak") || strings.Contains(inputURL, "nix-flatpak") {
+			fmt.Printf("- %s.nixosModules.nix-flatpak\n", inputName)
+			fmt.Printf("- %s.homeManagerModules.nix-flatpak\n", inputName)
+		} else if strings.Contains(inputURL, "hyprland") {
+			fmt.Printf("- %s.nixosModules.default\n", inputName)
+			fmt.Printf("- %s.homeManagerModules.default\n", inputName)
+		} else if strings.Contains(inputURL, "spicetify") {
+			fmt.Printf("- %s.nixosModules.default\n", inputName)
+			fmt.Printf("- %s.homeManagerModules.default\n", inputName)
+		} else {
+			// Generic suggestions
+			fmt.Printf("- %s.nixosModules.default\n", inputName)
+			fmt.Printf("- %s.homeManagerModules.default\n", inputName)
 		}
 	}
 
@@ -582,40 +588,38 @@ func getLatestNixpkgsVersion() (string, error) {
 // Update nixpkgs version in flake.nix
 func updateNixpkgsVersion(flakePath, newVersion string) error {
 	// Read the flake file
-	content, err := os.ReadFile(flakePath)
+	flake, err := parseNixFile(flakePath)
 	if err != nil {
 		return fmt.Errorf("error reading flake.nix: %v", err)
 	}
 
-	contentStr := string(content)
-	lines := strings.Split(contentStr, "\n")
-	updated := false
-
-	// Find and update nixpkgs.url line
-	for i, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.Contains(line, "nixpkgs.url =") && !strings.HasPrefix(line, "#") {
-			// Replace the version in the URL
-			if strings.Contains(lines[i], "nixos-") {
-				// Replace existing version
-				re := regexp.MustCompile(`nixos-[0-9]+\.[0-9]+`)
-				lines[i] = re.ReplaceAllString(lines[i], "nixos-"+newVersion)
-			} else {
-				// Add version if not present
-				re := regexp.MustCompile(`(nixpkgs\.url\s*=\s*".*github\.com/NixOS/nixpkgs)(.*")`)
-				lines[i] = re.ReplaceAllString(lines[i], "${1}/nixos-"+newVersion+"${2}")
-			}
-			updated = true
-			break
-		}
+	inputs, _, _ := flakeInputs(flake)
+	in := findInput(inputs, "nixpkgs")
+	if in == nil || in.URLNode == nil {
+		return fmt.Errorf("nixpkgs.url not found in flake.nix")
 	}
 
-	if !updated {
-		return fmt.Errorf("nixpkgs.url not found in flake.nix")
+	// Replace the version in the URL
+	var newURL string
+	if strings.Contains(in.URL, "nixos-") {
+		// Replace existing version
+		re := regexp.MustCompile(`nixos-[0-9]+\.[0-9]+`)
+		newURL = re.ReplaceAllString(in.URL, "nixos-"+newVersion)
+	} else {
+		// Add version if not present
+		re := regexp.MustCompile(`^(.*(?:github\.com/|github:)NixOS/nixpkgs)(.*)$`)
+		newURL = re.ReplaceAllString(in.URL, "${1}/nixos-"+newVersion+"${2}")
 	}
 
+	rw := nix.NewRewriter(flake)
+	rw.ReplaceString(in.URLNode, newURL)
+
 	// Write back to file
-	err = os.WriteFile(flakePath, []byte(strings.Join(lines, "\n")), 0644)
+	out, err := rw.Bytes()
+	if err != nil {
+		return fmt.Errorf("error editing flake.nix: %v", err)
+	}
+	err = changes.WriteFile(flakePath, out)
 	if err != nil {
 		return fmt.Errorf("error writing flake.nix: %v", err)
 	}
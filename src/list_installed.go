@@ -1,31 +1,85 @@
 package main
 
 import (
-	"bufio"
-	"os"
+	"alloylinux/apm/src/nix"
+	"regexp"
 	"strings"
 )
 
+// Package entry found in a config file
+type BlockEntry struct {
+	File string
+	Line int
+	Text string
+	// Scope of an enclosing `with <scope>;`, empty if none
+	Scope string
+}
+
+// Entry text with the with-scope applied
+func (e BlockEntry) Normalized() string {
+	return normalizeEntry(e.Text, e.Scope)
+}
+
+var bareAttrPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_'-]*(\.[A-Za-z0-9_'-]+)*$`)
+
+// Qualify bare names: git in a `with pkgs;` list is pkgs.git
+func normalizeEntry(text, scope string) string {
+	if scope == "" || !bareAttrPattern.MatchString(text) {
+		return text
+	}
+	if strings.HasPrefix(text, "pkgs.") || strings.HasPrefix(text, "unstable.") {
+		return text
+	}
+	return scope + "." + text
+}
+
+// Scope a list is written in, from `with pkgs; [ ... ]`
+func listScope(m nix.ListMatch) string {
+	if id, ok := m.With.(*nix.Identifier); ok {
+		return id.Name
+	}
+	return ""
+}
+
+// Entry as it should be written into a list: bare inside `with pkgs;`
+func entryForList(entry, scope string) string {
+	if scope == "" || !strings.HasPrefix(entry, scope+".") {
+		return entry
+	}
+	rest := strings.TrimPrefix(entry, scope+".")
+	// A quoted name on its own would be a string, keep the prefix
+	if strings.HasPrefix(rest, `"`) {
+		return entry
+	}
+	return rest
+}
+
 // List packages
 func ListInstalledPackages(flakeLocation string, method InstallationMethod) ([]string, error) {
-	files, err := ListFilePaths(flakeLocation)
+	entries, err := listBlockEntries(flakeLocation, method)
+	if err != nil {
+		return nil, err
+	}
+	var results []string
+	for _, e := range entries {
+		results = append(results, e.Normalized())
+	}
+	return results, nil
+}
+
+// List package entries with their location
+func listBlockEntries(flakeLocation string, method InstallationMethod) ([]BlockEntry, error) {
+	files, err := packageFiles(flakeLocation)
 	if err != nil {
 		return nil, err
 	}
 
-	var blockName string
-	switch method {
-	case NixEnv:
-		blockName = "environment.systemPackages"
-	case Flatpak:
-		blockName = "services.flatpak.packages"
-	case HomeManager:
-		blockName = "home.packages"
-	default:
+	blockName := blockNameForMethod(method)
+	if blockName == "" {
 		return nil, nil
 	}
 
-	var results []string
+	var results []BlockEntry
 	for _, f := range files {
 		if !strings.HasSuffix(f, ".nix") {
 			continue
@@ -42,74 +96,34 @@ func ListInstalledPackages(flakeLocation string, method InstallationMethod) ([]s
 }
 
 // Read block
-func readBlockEntries(path, blockName string) ([]string, error) {
-	f, err := os.Open(path)
+func readBlockEntries(path, blockName string) ([]BlockEntry, error) {
+	file, err := parseNixFile(path)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
 
-	scanner := bufio.NewScanner(f)
-	var inBlock bool
-	var entries []string
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !inBlock && strings.Contains(line, blockName) {
-			// Check if '[' is on the same line as blockName
-			if strings.Contains(line, "[") {
-				inBlock = true
-				// If there are entries on the same line after '[', extract them
-				bracketIndex := strings.Index(line, "[")
-				afterBracket := line[bracketIndex+1:]
-				trimmed := strings.TrimSpace(afterBracket)
-				if trimmed != "" && !strings.HasPrefix(trimmed, "]") {
-					// Remove trailing comments and brackets
-					if idx := strings.Index(trimmed, "#"); idx != -1 {
-						trimmed = trimmed[:idx]
-					}
-					trimmed = strings.TrimRight(trimmed, " ]")
-					if trimmed != "" {
-						entries = append(entries, strings.TrimSpace(trimmed))
-					}
-				}
-				continue
-			}
-			// If '[' is not on this line, wait for the next line with '['
-			continue
-		}
-		if inBlock {
-			if strings.Contains(line, "]") {
-				// Extract any remaining entries before the closing bracket
-				beforeBracket := line[:strings.Index(line, "]")]
-				trimmed := strings.TrimSpace(beforeBracket)
-				if trimmed != "" {
-					// Remove trailing comments
-					if idx := strings.Index(trimmed, "#"); idx != -1 {
-						trimmed = trimmed[:idx]
-					}
-					if trimmed != "" {
-						entries = append(entries, strings.TrimSpace(trimmed))
-					}
-				}
-				break
-			}
-			trimmed := strings.TrimSpace(line)
-			if trimmed == "" {
-				continue
-			}
-			// Remove comments
-			if idx := strings.Index(trimmed, "#"); idx != -1 {
-				trimmed = trimmed[:idx]
-			}
-			trimmed = strings.TrimSpace(trimmed)
-			if trimmed == "" || trimmed == "[" {
-				continue
-			}
-			entries = append(entries, trimmed)
+	var entries []BlockEntry
+	for _, m := range packageLists(path, file, blockName) {
+		scope := listScope(m)
+		for _, elem := range m.List.Elems {
+			line, _ := file.Position(elem.Pos())
+			entries = append(entries, BlockEntry{
+				File: path,
+				Line: line,
+				// Multi-line entries are shown on one line
+				Text:  strings.Join(strings.Fields(file.Text(elem)), " "),
+				Scope: scope,
+			})
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		return nil, err
-	}
 	return entries, nil
 }
+
+// Check if a file assigns the block
+func fileHasBlock(path, blockName string) bool {
+	file, err := parseNixFile(path)
+	if err != nil {
+		return false
+	}
+	return len(packageLists(path, file, blockName)) > 0
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestNormalizeEntry(t *testing.T) {
+	tests := []struct {
+		text, scope, want string
+	}{
+		{"pkgs.git", "", "pkgs.git"},
+		{"unstable.git", "", "unstable.git"},
+		{"git", "", "git"},
+		{"git", "pkgs", "pkgs.git"},
+		{"kdePackages.kate", "pkgs", "pkgs.kdePackages.kate"},
+		{"pkgs.git", "pkgs", "pkgs.git"},
+		{"unstable.git", "pkgs", "unstable.git"},
+		{"git", "unstable", "unstable.git"},
+		// Not a plain attribute path, left alone
+		{`(git.override { })`, "pkgs", `(git.override { })`},
+		{`{ appId = "org.gnome.Evince"; origin = "flathub"; }`, "pkgs", `{ appId = "org.gnome.Evince"; origin = "flathub"; }`},
+	}
+	for _, tt := range tests {
+		if got := normalizeEntry(tt.text, tt.scope); got != tt.want {
+			t.Errorf("normalizeEntry(%q, %q) = %q, want %q", tt.text, tt.scope, got, tt.want)
+		}
+	}
+}
+
+func TestEntryForList(t *testing.T) {
+	tests := []struct {
+		entry, scope, want string
+	}{
+		{"pkgs.git", "", "pkgs.git"},
+		{"pkgs.git", "pkgs", "git"},
+		{"pkgs.kdePackages.kate", "pkgs", "kdePackages.kate"},
+		{"unstable.git", "pkgs", "unstable.git"},
+		{"unstable.git", "unstable", "git"},
+		// A bare quoted name would be a string
+		{`pkgs."3proxy"`, "pkgs", `pkgs."3proxy"`},
+	}
+	for _, tt := range tests {
+		if got := entryForList(tt.entry, tt.scope); got != tt.want {
+			t.Errorf("entryForList(%q, %q) = %q, want %q", tt.entry, tt.scope, got, tt.want)
+		}
+	}
+}
+
+func TestInsertIntoWithList(t *testing.T) {
+	testEnv(t)
+	file := filepath.Join(t.TempDir(), "packages.nix")
+	writeTestFile(t, file, "{ pkgs, ... }:\n{\n  environment.systemPackages = with pkgs; [\n    git\n  ];\n}\n")
+
+	entries := []string{"pkgs.git", "pkgs.htop", "unstable.ripgrep", `pkgs."3proxy"`}
+	added, res, err := insertIntoNixBlock(file, "environment.systemPackages", entries, NixEnv)
+	if err != nil || res != InsertAdded {
+		t.Fatalf("insertIntoNixBlock() = %v, %v", res, err)
+	}
+	// git is already there as a bare name
+	if len(added) != 3 {
+		t.Errorf("added %q, want everything but pkgs.git", added)
+	}
+	want := "{ pkgs, ... }:\n{\n  environment.systemPackages = with pkgs; [\n    git\n    htop\n    unstable.ripgrep\n    pkgs.\"3proxy\"\n  ];\n}\n"
+	if got := readTestFile(t, file); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	_, res, err = insertIntoNixBlock(file, "environment.systemPackages", []string{"pkgs.htop"}, NixEnv)
+	if err != nil || res != InsertAlreadyPresent {
+		t.Errorf("second insert = %v, %v; want InsertAlreadyPresent", res, err)
+	}
+}
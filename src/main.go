@@ -2,10 +2,10 @@ package main
 
 import (
 	cache "alloylinux/apm/src/database"
+	"errors"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 
@@ -13,21 +13,55 @@ import (
 )
 
 func main() {
-	// Setup config paths
-	homedir, err := os.UserHomeDir()
+	// Load settings, moving older setting files into config.json
+	var err error
+	settings, err = loadConfig()
 	if err != nil {
-		log.Fatalf("Error getting home directory: %v", err)
+		log.Fatalf("Error loading config: %v", err)
 	}
 
-	configDir := filepath.Join(homedir, ".config", "apm")
-	flakeLocationPath := filepath.Join(homedir, ".config", "apm", "flakelocation.txt")
-
-	ensureFlakeLocationExists(configDir, flakeLocationPath)
-
 	var rootCmd = &cobra.Command{
 		Use:   "apm",
 		Short: "Apm is a CLI tool for managing packages on Alloy Linux and other NixOS-based systems.",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			profile, _ := cmd.Flags().GetString("profile")
+			selectProfile(profile)
+			host, _ := cmd.Flags().GetString("host")
+			selectHost(host)
+
+			yes, _ := cmd.Flags().GetBool("yes")
+			no, _ := cmd.Flags().GetBool("no")
+			assumeDefault, _ := cmd.Flags().GetBool("assume-default")
+			mode, err := ParsePromptMode(yes, no, assumeDefault)
+			if err != nil {
+				return err
+			}
+			// Without a flag, the config file decides
+			if !yes && !no && !assumeDefault {
+				if mode, err = parsePromptSetting(settings.Prompt); err != nil {
+					return fmt.Errorf("bad prompt setting: %v", err)
+				}
+			}
+			prompter.Mode = mode
+
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+			changes.DryRun = dryRun
+			prompter.DryRun = dryRun
+			return nil
+		},
+		PersistentPostRun: func(cmd *cobra.Command, args []string) {
+			if changes.DryRun {
+				changes.Report(os.Stdout)
+			}
+		},
 	}
+	// global prompt flags
+	rootCmd.PersistentFlags().BoolP("yes", "y", false, "Answer yes to every prompt")
+	rootCmd.PersistentFlags().Bool("no", false, "Answer no to every prompt")
+	rootCmd.PersistentFlags().Bool("assume-default", false, "Take the default answer for every prompt")
+	rootCmd.PersistentFlags().Bool("dry-run", false, "Show the changes as a diff without writing anything")
+	rootCmd.PersistentFlags().String("host", "", "nixosConfigurations or homeConfigurations entry whose modules to edit and rebuild (default: all files)")
+	rootCmd.PersistentFlags().String("profile", "", "Profile whose flake to use (default $APM_PROFILE, then 'apm profile use')")
 
 	var listPackages = &cobra.Command{
 		Use:   "list",
@@ -43,7 +77,7 @@ func main() {
 				return
 			}
 			// Read the actual flake directory from the config file
-			flakeDir, err := readFlakeLocation(flakeLocationPath)
+			flakeDir, err := configuredFlakeDir()
 			if err != nil {
 				fmt.Printf("Error reading flake location: %v\n", err)
 				return
@@ -65,9 +99,9 @@ func main() {
 	listPackages.Flags().Bool("home-manager", false, "List HomeManager packages")
 
 	var addCmd = &cobra.Command{
-		Use:   "add [package]",
-		Short: "Add a package to configuration.",
-		Args:  cobra.ExactArgs(1),
+		Use:   "add [package...]",
+		Short: "Add one or more packages to configuration.",
+		Args:  cobra.MinimumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			flatpak, _ := cmd.Flags().GetBool("flatpak")
 			nixEnv, _ := cmd.Flags().GetBool("nix-env")
@@ -78,90 +112,230 @@ func main() {
 				return
 			}
 			// Get flake directory
-			flakeDir, err := readFlakeLocation(flakeLocationPath)
+			flakeDir, err := configuredFlakeDir()
 			if err != nil {
 				log.Fatalf("Error reading flake location file: %v", err)
 			}
 			unstable, _ := cmd.Flags().GetBool("unstable")
+			if !cmd.Flags().Changed("unstable") {
+				unstable = settings.Channel == unstableChannel
+			}
 			exact, _ := cmd.Flags().GetBool("exact")
+			file, _ := cmd.Flags().GetString("file")
+
+			// Resolve every name first, then install them together
+			if method != Flatpak {
+				warnIfCacheStale(flakeDir, installChannel(unstable))
+			}
+			pkgNames, failures := resolvePackages(args, method, exact, installChannel(unstable))
+			if len(pkgNames) > 0 {
+				description := fmt.Sprintf("add %s (%s)", strings.Join(pkgNames, " "), methodFlagName(method))
+				err := runTx(description, func() error {
+					return installPackages(pkgNames, flakeDir, method, unstable, file)
+				})
+				if err != nil {
+					fmt.Printf("Error: %v\n", err)
+				}
+			}
+			if len(failures) > 0 {
+				fmt.Println("Could not resolve:")
+				for _, f := range failures {
+					fmt.Printf("  - %s\n", f)
+				}
+			}
+		},
+	}
+	// add --unstable flag
+	addCmd.Flags().BoolP("unstable", "u", false, "Install from unstable channel")
+	addCmd.Flags().BoolP("exact", "e", false, "Exact package name (no search)")
+	addCmd.Flags().StringP("file", "f", "", "Package file to add to, relative to the flake (default files.<method> from the config)")
+	// add method flags
+	addCmd.Flags().Bool("flatpak", false, "Install as Flatpak")
+	addCmd.Flags().Bool("nix-env", false, "Install as NixEnv")
+	addCmd.Flags().Bool("home-manager", false, "Install as HomeManager")
 
-			if exact {
-				// Install directly
-				installPackage(args[0], flakeDir, method, unstable)
-				return
+	var infoCmd = &cobra.Command{
+		Use:   "info [package]",
+		Short: "Show details of a package and where it is installed.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			flatpak, _ := cmd.Flags().GetBool("flatpak")
+			// Without a flake, only the install locations are left out
+			flakeDir, err := configuredFlakeDir()
+			if err != nil && !errors.Is(err, errNoFlake) {
+				fmt.Printf("Warning: install location unknown: %v\n", err)
+			}
+			show := showPackageInfo
+			if flatpak {
+				show = showFlatpakInfo
 			}
+			if err := show(args[0], flakeDir); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+		},
+	}
+	infoCmd.Flags().Bool("flatpak", false, "Show a Flathub app")
 
-			// Search for packages
-			candidates, err := SearchPackages(args[0], method)
+	var removeCmd = &cobra.Command{
+		Use:   "remove [package]",
+		Short: "Remove a package from configuration.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			flatpak, _ := cmd.Flags().GetBool("flatpak")
+			nixEnv, _ := cmd.Flags().GetBool("nix-env")
+			homeManager, _ := cmd.Flags().GetBool("home-manager")
+			method, err := DetermineMethod(flatpak, nixEnv, homeManager)
 			if err != nil {
-				fmt.Printf("Error searching packages: %v\n", err)
+				fmt.Println("Error: " + err.Error())
 				return
 			}
-			if len(candidates) == 0 {
-				fmt.Println("No matching packages found. Try --exact or run makecache.")
+			flakeDir, err := configuredFlakeDir()
+			if err != nil {
+				log.Fatalf("Error reading flake location file: %v", err)
+			}
+			description := fmt.Sprintf("remove %s (%s)", args[0], methodFlagName(method))
+			err = runTx(description, func() error {
+				return removePackage(args[0], flakeDir, method)
+			})
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+		},
+	}
+	// add method flags
+	removeCmd.Flags().Bool("flatpak", false, "Remove a Flatpak")
+	removeCmd.Flags().Bool("nix-env", false, "Remove from NixEnv")
+	removeCmd.Flags().Bool("home-manager", false, "Remove from HomeManager")
+
+	var setFlakeLocation = &cobra.Command{
+		Use:   "set-flake-location [location]",
+		Short: "Set the flake path of the active profile.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setProfileFlake(args[0]); err != nil {
+				log.Printf("Error: %v", err)
 				return
 			}
-			if len(candidates) == 1 {
-				// Ask for confirmation
-				fmt.Printf("Install '%s'? [y/N]: ", candidates[0].Pname)
-				var ans string
-				_, err = fmt.Scanln(&ans)
-				if err != nil {
-					fmt.Println("No selection made")
-					return
-				}
-				if strings.ToLower(strings.TrimSpace(ans)) == "y" {
-					installPackage(candidates[0].Pname, flakeDir, method, unstable)
-				}
+			fmt.Printf("Flake location set to: %s\n", args[0])
+		},
+	}
+
+	var configCmd = &cobra.Command{
+		Use:   "config",
+		Short: "Show and change apm settings.",
+	}
+
+	var configGetCmd = &cobra.Command{
+		Use:   "get [key]",
+		Short: "Print one setting.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			value, err := getConfigKey(settings, args[0])
+			if err != nil {
+				log.Printf("Error: %v", err)
 				return
 			}
-			// Show numbered list
-			fmt.Println("Multiple matches found; choose one:")
-			for i, p := range candidates {
-				fmt.Printf("%d) %s - %s\n", i+1, p.Pname, p.Description)
+			fmt.Println(value)
+		},
+	}
+
+	var configSetCmd = &cobra.Command{
+		Use:   "set [key] [value]",
+		Short: "Change one setting.",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setConfigValue(args[0], args[1]); err != nil {
+				log.Printf("Error: %v", err)
+				return
 			}
-			var choice int
-			fmt.Print("Select number: ")
-			_, err = fmt.Scanln(&choice)
-			if err != nil {
-				fmt.Println("Invalid selection")
+			value, _ := getConfigKey(settings, args[0])
+			fmt.Printf("%s = %s\n", args[0], value)
+		},
+	}
+
+	var configListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "Print every setting with what it does.",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if path, err := configPath(); err == nil {
+				fmt.Printf("# %s\n", path)
+			}
+			for _, k := range configKeys {
+				fmt.Printf("%s = %s\n", k.Name, k.Get(settings))
+				fmt.Printf("    %s\n", k.Help)
+			}
+		},
+	}
+	configCmd.AddCommand(configGetCmd)
+	configCmd.AddCommand(configSetCmd)
+	configCmd.AddCommand(configListCmd)
+
+	var profileCmd = &cobra.Command{
+		Use:   "profile",
+		Short: "Manage named flakes, e.g. one per machine.",
+	}
+
+	var profileAddCmd = &cobra.Command{
+		Use:   "add [name] [flake]",
+		Short: "Add a profile, or point an existing one at another flake.",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := addProfile(args[0], args[1]); err != nil {
+				log.Printf("Error: %v", err)
 				return
 			}
-			if choice < 1 || choice > len(candidates) {
-				fmt.Println("Selection out of range")
+			fmt.Printf("Profile %s uses %s\n", args[0], args[1])
+		},
+	}
+
+	var profileListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List profiles, marking the active one.",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			listProfiles()
+		},
+	}
+
+	var profileUseCmd = &cobra.Command{
+		Use:   "use [name]",
+		Short: "Use a profile when neither --profile nor APM_PROFILE is given; 'default' for the top-level flake.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := useProfile(args[0]); err != nil {
+				log.Printf("Error: %v", err)
 				return
 			}
-			installPackage(candidates[choice-1].Pname, flakeDir, method, unstable)
+			fmt.Printf("Now using profile %s\n", args[0])
+			if env := os.Getenv("APM_PROFILE"); env != "" && env != args[0] {
+				fmt.Printf("Note: APM_PROFILE=%s still takes precedence in this shell\n", env)
+			}
 		},
 	}
-	// add --unstable flag
-	addCmd.Flags().BoolP("unstable", "u", false, "Install from unstable channel")
-	addCmd.Flags().BoolP("exact", "e", false, "Exact package name (no search)")
-	// add method flags
-	addCmd.Flags().Bool("flatpak", false, "Install as Flatpak")
-	addCmd.Flags().Bool("nix-env", false, "Install as NixEnv")
-	addCmd.Flags().Bool("home-manager", false, "Install as HomeManager")
 
-	var setFlakeLocation = &cobra.Command{
-		Use:   "set-flake-location [location]",
-		Short: "Set the flake path for package management.",
+	var profileRemoveCmd = &cobra.Command{
+		Use:   "remove [name]",
+		Short: "Forget a profile; its flake is left alone.",
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			createFlakeLocationFile(configDir, args)
+			if err := removeProfile(args[0]); err != nil {
+				log.Printf("Error: %v", err)
+				return
+			}
+			fmt.Printf("Removed profile %s\n", args[0])
 		},
 	}
+	profileCmd.AddCommand(profileAddCmd)
+	profileCmd.AddCommand(profileListCmd)
+	profileCmd.AddCommand(profileUseCmd)
+	profileCmd.AddCommand(profileRemoveCmd)
 
 	var updateCmd = &cobra.Command{
 		Use:   "update",
 		Short: "Update the flake inputs.",
 		Run: func(cmd *cobra.Command, args []string) {
-			homedir, err := os.UserHomeDir()
-			if err != nil {
-				log.Printf("Error getting home directory: %v", err)
-				return
-			}
-			flakeLocationPath := filepath.Join(homedir, ".config", "apm", "flakelocation.txt")
-			flakeDir, err := readFlakeLocation(flakeLocationPath)
+			flakeDir, err := configuredFlakeDir()
 			if err != nil {
 				log.Printf("Error reading flake location: %v", err)
 				return
@@ -174,12 +348,11 @@ func main() {
 			}
 
 			fmt.Println("Updating flake inputs...")
-			cmdExec := exec.Command("sudo", "nix", "flake", "update")
-			cmdExec.Dir = flakeDir
+			cmdExec := flakeCommand(flakeDir, "nix", "flake", "update")
 			cmdExec.Stdout = os.Stdout
 			cmdExec.Stderr = os.Stderr
-			if err := cmdExec.Run(); err != nil {
-				log.Printf("Error running nix flake update with sudo: %v", err)
+			if err := changes.Run(cmdExec); err != nil {
+				log.Printf("Error running nix flake update: %v", err)
 				fmt.Println("\nTroubleshooting:")
 				fmt.Println("- Make sure you have sudo permissions")
 				fmt.Println("- Check that your user is in the sudoers file")
@@ -192,26 +365,24 @@ func main() {
 	// Rebuild command
 	var rebuildCmd = &cobra.Command{
 		Use:   "rebuild",
-		Short: "Rebuild the NixOS/Alloy system.",
+		Short: "Rebuild the NixOS/Alloy system, or switch a standalone Home Manager configuration.",
 		Run: func(cmd *cobra.Command, args []string) {
 			// rebuild the system
-			homedir, err := os.UserHomeDir()
+			flakeDir, err := configuredFlakeDir()
 			if err != nil {
-				log.Printf("Error getting home directory: %v", err)
+				log.Printf("Error reading flake location: %v", err)
 				return
 			}
-			flakeLocationPath := filepath.Join(homedir, ".config", "apm", "flakelocation.txt")
-			flakeDir, err := readFlakeLocation(flakeLocationPath)
+
+			cmdExec, err := rebuildCommand(flakeDir)
 			if err != nil {
-				log.Printf("Error reading flake location: %v", err)
+				log.Printf("Error: %v", err)
 				return
 			}
-
-			cmdExec := exec.Command("sudo", "nixos-rebuild", "switch", "--flake", flakeDir)
 			cmdExec.Stdout = os.Stdout
 			cmdExec.Stderr = os.Stderr
-			if err := cmdExec.Run(); err != nil {
-				log.Printf("Error running nixos-rebuild: %v", err)
+			if err := changes.Run(cmdExec); err != nil {
+				log.Printf("Error running %s: %v", filepath.Base(cmdExec.Path), err)
 				return
 			}
 		},
@@ -221,9 +392,174 @@ func main() {
 		Use:   "makecache",
 		Short: "Update the package cache.",
 		Run: func(cmd *cobra.Command, args []string) {
-			cache.MakeCache()
+			quiet, _ := cmd.Flags().GetBool("quiet")
+			only, _ := cmd.Flags().GetString("channel")
+			build, _ := cmd.Flags().GetBool("build")
+			source, _ := cmd.Flags().GetString("download")
+			if build && source != "" {
+				fmt.Println("Error: --build and --download can't be combined")
+				return
+			}
+			// Plain makecache downloads once a source is set
+			if source == "" && !build {
+				source = cacheSource()
+			}
+			flakeDir, err := configuredFlakeDir()
+			if err != nil {
+				log.Printf("Error reading flake location: %v", err)
+				return
+			}
+
+			// One cache per nixpkgs-like input
+			channels := packageChannels(flakeDir)
+			if only != "" {
+				ch, ok := findChannel(channels, only)
+				if !ok {
+					fmt.Printf("Error: no nixpkgs input named '%s' in flake\n", only)
+					return
+				}
+				channels = []cache.Channel{ch}
+			}
+			opts := cache.Options{Quiet: quiet}
+			for _, ch := range channels {
+				if source != "" {
+					if err := downloadCache(ch, source, opts); err != nil {
+						fmt.Printf("Error downloading cache for %s: %v\n", ch.Name, err)
+					}
+					continue
+				}
+				if err := cache.MakeCache(ch, opts); err != nil {
+					fmt.Printf("Error building cache for %s: %v\n", ch.Name, err)
+				}
+			}
 		},
 	}
+	makecacheCmd.Flags().BoolP("quiet", "q", false, "Only print errors")
+	makecacheCmd.Flags().String("channel", "", "Only build the cache for this nixpkgs input")
+	makecacheCmd.Flags().String("download", "", "Download a prebuilt cache from this URL instead of building it")
+	makecacheCmd.Flags().Bool("build", false, "Build locally with nix-env even when a cache source is set")
+
+	var searchCmd = &cobra.Command{
+		Use:   "search [terms...]",
+		Short: "Search package names, descriptions and attribute paths.",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			limit, _ := cmd.Flags().GetInt("limit")
+			offset, _ := cmd.Flags().GetInt("offset")
+			channel, _ := cmd.Flags().GetString("channel")
+			if channel == "" {
+				channel = settings.Channel
+			}
+			if unstable, _ := cmd.Flags().GetBool("unstable"); unstable {
+				channel = unstableChannel
+			}
+			if limit < 1 || offset < 0 {
+				fmt.Println("Error: --limit must be positive and --offset not negative")
+				return
+			}
+			if flakeDir, err := configuredFlakeDir(); err == nil {
+				warnIfCacheStale(flakeDir, channel)
+			}
+			results, total, err := cache.Search(channel, args, limit, offset)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			if total == 0 {
+				fmt.Println("No packages found.")
+				return
+			}
+			for _, p := range results {
+				name := p.AttrPath
+				if name == "" {
+					name = p.Pname
+				}
+				flags := ""
+				if w := p.Warnings(hostSystem()); len(w) > 0 {
+					flags = " [" + strings.Join(w, ", ") + "]"
+				}
+				fmt.Printf("%s (%s)%s\n", name, p.Version, flags)
+				if p.Description != "" {
+					fmt.Printf("    %s\n", p.Description)
+				}
+			}
+			if len(results) == 0 {
+				fmt.Printf("No results past %d (%d total)\n", offset, total)
+				return
+			}
+			fmt.Printf("\nShowing %d-%d of %d results\n", offset+1, offset+len(results), total)
+		},
+	}
+	// add paging flags
+	searchCmd.Flags().IntP("limit", "n", 20, "Number of results to show")
+	searchCmd.Flags().Int("offset", 0, "Number of results to skip")
+	searchCmd.Flags().String("channel", "", "Nixpkgs input to search (default: the configured channel)")
+	searchCmd.Flags().BoolP("unstable", "u", false, "Search the unstable channel")
+
+	var cacheCmd = &cobra.Command{
+		Use:   "cache",
+		Short: "Inspect and configure the package caches.",
+	}
+
+	var cacheStatusCmd = &cobra.Command{
+		Use:   "status",
+		Short: "Show when and from what each package cache was built.",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			names, err := cache.CachedChannels()
+			if err != nil {
+				log.Printf("Error listing caches: %v", err)
+				return
+			}
+			if len(names) == 0 {
+				fmt.Println("No package caches. Generate them with 'apm makecache'")
+				return
+			}
+			var channels []cache.Channel
+			if flakeDir, err := configuredFlakeDir(); err == nil {
+				channels = packageChannels(flakeDir)
+			}
+			maxAge := cacheMaxAge()
+			for i, name := range names {
+				if i > 0 {
+					fmt.Println()
+				}
+				info, err := cache.ReadInfo(name)
+				if err != nil {
+					fmt.Printf("%s: %v\n", name, err)
+					continue
+				}
+				printCacheInfo(info, channels, maxAge)
+			}
+		},
+	}
+
+	var cachePackCmd = &cobra.Command{
+		Use:   "pack [dir]",
+		Short: "Write compressed caches and manifests for makecache --download.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			names, err := cache.CachedChannels()
+			if err != nil {
+				log.Printf("Error listing caches: %v", err)
+				return
+			}
+			if len(names) == 0 {
+				fmt.Println("No package caches. Generate them with 'apm makecache'")
+				return
+			}
+			for _, name := range names {
+				m, err := cache.Pack(name, args[0])
+				if err != nil {
+					fmt.Printf("Error packing %s: %v\n", name, err)
+					continue
+				}
+				fmt.Printf("Packed %s as %s (%d packages, %.1f MB)\n", name, filepath.Join(args[0], m.File), m.Count, float64(m.Size)/(1<<20))
+			}
+		},
+	}
+	cacheCmd.AddCommand(cacheStatusCmd)
+	cacheCmd.AddCommand(cachePackCmd)
 
 	var removecacheCmd = &cobra.Command{
 		Use:   "removecache",
@@ -237,7 +573,9 @@ func main() {
 		Use:   "makenixenv",
 		Short: "Create Nix environment structure and packages file.",
 		Run: func(cmd *cobra.Command, args []string) {
-			makeNixEnv()
+			if err := runTx("makenixenv", makeNixEnv); err != nil {
+				log.Printf("Error: %v", err)
+			}
 		},
 	}
 
@@ -245,7 +583,9 @@ func main() {
 		Use:   "makehomeenv",
 		Short: "Create Home Manager packages file.",
 		Run: func(cmd *cobra.Command, args []string) {
-			makeHomeEnv()
+			if err := runTx("makehomeenv", makeHomeEnv); err != nil {
+				log.Printf("Error: %v", err)
+			}
 		},
 	}
 
@@ -253,7 +593,9 @@ func main() {
 		Use:   "setupflatpak",
 		Short: "Add Flatpak module to flake configuration.",
 		Run: func(cmd *cobra.Command, args []string) {
-			setupFlatpak()
+			if err := runTx("setupflatpak", setupFlatpak); err != nil {
+				log.Printf("Error: %v", err)
+			}
 		},
 	}
 
@@ -262,20 +604,15 @@ func main() {
 		Short: "Add an input to flake configuration.",
 		Args:  cobra.ExactArgs(2),
 		Run: func(cmd *cobra.Command, args []string) {
-			homedir, err := os.UserHomeDir()
-			if err != nil {
-				log.Printf("Error getting home directory: %v", err)
-				return
-			}
-
-			flakeLocationPath := filepath.Join(homedir, ".config", "apm", "flakelocation.txt")
-			flakeDir, err := readFlakeLocation(flakeLocationPath)
+			flakeDir, err := configuredFlakeDir()
 			if err != nil {
 				log.Printf("Error reading flake location: %v", err)
 				return
 			}
 
-			err = addInput(filepath.Join(flakeDir, "flake.nix"), args[0], args[1])
+			err = runTx("add-input "+args[0], func() error {
+				return addInput(filepath.Join(flakeDir, "flake.nix"), args[0], args[1])
+			})
 			if err != nil {
 				log.Printf("Error adding input: %v", err)
 			}
@@ -286,14 +623,7 @@ func main() {
 		Use:   "show-nixpkgs-version",
 		Short: "Show the current nixpkgs version in flake configuration.",
 		Run: func(cmd *cobra.Command, args []string) {
-			homedir, err := os.UserHomeDir()
-			if err != nil {
-				log.Printf("Error getting home directory: %v", err)
-				return
-			}
-
-			flakeLocationPath := filepath.Join(homedir, ".config", "apm", "flakelocation.txt")
-			flakeDir, err := readFlakeLocation(flakeLocationPath)
+			flakeDir, err := configuredFlakeDir()
 			if err != nil {
 				log.Printf("Error reading flake location: %v", err)
 				return
@@ -313,14 +643,7 @@ func main() {
 		Use:   "update-nixpkgs",
 		Short: "Update nixpkgs to the latest stable version in flake configuration.",
 		Run: func(cmd *cobra.Command, args []string) {
-			homedir, err := os.UserHomeDir()
-			if err != nil {
-				log.Printf("Error getting home directory: %v", err)
-				return
-			}
-
-			flakeLocationPath := filepath.Join(homedir, ".config", "apm", "flakelocation.txt")
-			flakeDir, err := readFlakeLocation(flakeLocationPath)
+			flakeDir, err := configuredFlakeDir()
 			if err != nil {
 				log.Printf("Error reading flake location: %v", err)
 				return
@@ -352,16 +675,20 @@ func main() {
 			}
 
 			// Ask for confirmation
-			fmt.Printf("Update nixpkgs from %s to %s? [y/N]: ", currentVersion, latestVersion)
-			var response string
-			fmt.Scanln(&response)
-			if strings.ToLower(strings.TrimSpace(response)) != "y" {
+			ok, err := prompter.Confirm(fmt.Sprintf("Update nixpkgs from %s to %s?", currentVersion, latestVersion), false)
+			if err != nil {
+				log.Printf("Error: %v", err)
+				return
+			}
+			if !ok {
 				fmt.Println("Update cancelled.")
 				return
 			}
 
 			// Update the flake
-			err = updateNixpkgsVersion(flakePath, latestVersion)
+			err = runTx("update-nixpkgs "+latestVersion, func() error {
+				return updateNixpkgsVersion(flakePath, latestVersion)
+			})
 			if err != nil {
 				log.Printf("Error updating nixpkgs version: %v", err)
 				return
@@ -371,13 +698,12 @@ func main() {
 
 			// Update flake lock file
 			fmt.Println("Updating flake lock file...")
-			cmdExec := exec.Command("sudo", "nix", "flake", "update")
-			cmdExec.Dir = flakeDir
+			cmdExec := flakeCommand(flakeDir, "nix", "flake", "update")
 			cmdExec.Stdout = os.Stdout
 			cmdExec.Stderr = os.Stderr
-			if err := cmdExec.Run(); err != nil {
-				log.Printf("Warning: Failed to update flake lock file with sudo: %v", err)
-				fmt.Println("You may need to check your sudo permissions.")
+			if err := changes.Run(cmdExec); err != nil {
+				log.Printf("Warning: Failed to update flake lock file: %v", err)
+				fmt.Println("You may need to check your permissions, or the sudo setting (apm config get sudo).")
 			} else {
 				fmt.Println("Flake lock file updated successfully!")
 			}
@@ -390,14 +716,7 @@ func main() {
 		Use:   "list-inputs",
 		Short: "List all inputs in flake configuration.",
 		Run: func(cmd *cobra.Command, args []string) {
-			homedir, err := os.UserHomeDir()
-			if err != nil {
-				log.Printf("Error getting home directory: %v", err)
-				return
-			}
-
-			flakeLocationPath := filepath.Join(homedir, ".config", "apm", "flakelocation.txt")
-			flakeDir, err := readFlakeLocation(flakeLocationPath)
+			flakeDir, err := configuredFlakeDir()
 			if err != nil {
 				log.Printf("Error reading flake location: %v", err)
 				return
@@ -414,22 +733,58 @@ func main() {
 		Use:   "list-modules",
 		Short: "List available modules from flake inputs.",
 		Run: func(cmd *cobra.Command, args []string) {
-			homedir, err := os.UserHomeDir()
+			flakeDir, err := configuredFlakeDir()
 			if err != nil {
-				log.Printf("Error getting home directory: %v", err)
+				log.Printf("Error reading flake location: %v", err)
 				return
 			}
 
-			flakeLocationPath := filepath.Join(homedir, ".config", "apm", "flakelocation.txt")
-			flakeDir, err := readFlakeLocation(flakeLocationPath)
+			err = extractInputModules(filepath.Join(flakeDir, "flake.nix"))
+			if err != nil {
+				log.Printf("Error extracting modules: %v", err)
+			}
+		},
+	}
+
+	var listHostsCmd = &cobra.Command{
+		Use:   "list-hosts",
+		Short: "List the nixosConfigurations and homeConfigurations of the flake and the files each one uses.",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			flakeDir, err := configuredFlakeDir()
 			if err != nil {
 				log.Printf("Error reading flake location: %v", err)
 				return
 			}
 
-			err = extractInputModules(filepath.Join(flakeDir, "flake.nix"))
-			if err != nil {
-				log.Printf("Error extracting modules: %v", err)
+			if err := listHosts(flakeDir); err != nil {
+				log.Printf("Error listing hosts: %v", err)
+			}
+		},
+	}
+
+	var restoreCmd = &cobra.Command{
+		Use:   "restore [txid]",
+		Short: "Undo the file changes of a past command, or list them without an id.",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) == 0 {
+				txs, err := listTransactions()
+				if err != nil {
+					log.Printf("Error listing transactions: %v", err)
+					return
+				}
+				if len(txs) == 0 {
+					fmt.Println("No transactions recorded.")
+					return
+				}
+				for _, tx := range txs {
+					fmt.Printf("%-18s %s  %-11s %s (%d file(s))\n", tx.ID, tx.Time.Format("2006-01-02 15:04"), tx.Status, tx.Description, len(tx.Files))
+				}
+				return
+			}
+			if err := restoreTransaction(args[0]); err != nil {
+				log.Printf("Error restoring transaction: %v", err)
 			}
 		},
 	}
@@ -438,9 +793,15 @@ func main() {
 	rootCmd.AddCommand(updateCmd)
 	rootCmd.AddCommand(listPackages)
 	rootCmd.AddCommand(setFlakeLocation)
+	rootCmd.AddCommand(configCmd)
+	rootCmd.AddCommand(profileCmd)
 	rootCmd.AddCommand(makecacheCmd)
 	rootCmd.AddCommand(removecacheCmd)
+	rootCmd.AddCommand(cacheCmd)
+	rootCmd.AddCommand(searchCmd)
+	rootCmd.AddCommand(infoCmd)
 	rootCmd.AddCommand(addCmd)
+	rootCmd.AddCommand(removeCmd)
 	rootCmd.AddCommand(rebuildCmd)
 	rootCmd.AddCommand(makenixenvCmd)
 	rootCmd.AddCommand(makehomeenvCmd)
@@ -448,55 +809,12 @@ func main() {
 	rootCmd.AddCommand(addInputCmd)
 	rootCmd.AddCommand(listInputsCmd)
 	rootCmd.AddCommand(listModulesCmd)
+	rootCmd.AddCommand(listHostsCmd)
 	rootCmd.AddCommand(showNixpkgsVersionCmd)
 	rootCmd.AddCommand(updateNixpkgsCmd)
+	rootCmd.AddCommand(restoreCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatal(err)
 	}
 }
-
-func createFlakeLocationFile(configDir string, args []string) {
-	// Create flake file
-	if err := os.MkdirAll(configDir, 0o755); err != nil {
-		log.Fatalf("Error creating config directory: %v", err)
-	}
-
-	file, err := os.Create(configDir + "/flakelocation.txt")
-	if err != nil {
-		log.Fatalf("Error creating flake location file: %v", err)
-	}
-	defer file.Close()
-
-	if _, err := file.Write([]byte(args[0])); err != nil {
-		log.Fatalf("Error writing to flake location file: %v", err)
-	}
-
-	fmt.Printf("Flake location set to: %s\n", args[0])
-}
-
-// Ensure flake file
-func ensureFlakeLocationExists(configDir, flakePath string) {
-	if _, err := os.Stat(flakePath); os.IsNotExist(err) {
-		if err := os.MkdirAll(configDir, 0o755); err != nil {
-			log.Fatalf("Error creating config directory: %v", err)
-		}
-		file, err := os.Create(flakePath)
-		if err != nil {
-			log.Fatalf("Error creating flake location file: %v", err)
-		}
-		defer file.Close()
-		if _, err := file.Write([]byte("/etc/nixos/")); err != nil {
-			log.Fatalf("Error writing default flake location: %v", err)
-		}
-	}
-}
-
-// Read flake path
-func readFlakeLocation(path string) (string, error) {
-	b, err := os.ReadFile(path)
-	if err != nil {
-		return "", err
-	}
-	return strings.TrimSpace(string(b)), nil
-}
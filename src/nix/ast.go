@@ -0,0 +1,172 @@
+package nix
+
+// Every node knows its byte range in the source
+type Node interface {
+	Pos() int
+	End() int
+}
+
+type span struct {
+	start int
+	end   int
+}
+
+func (s span) Pos() int { return s.start }
+func (s span) End() int { return s.end }
+
+type (
+	// Variable reference
+	Identifier struct {
+		span
+		Name string
+	}
+
+	// Integer, float, URI, path or search path
+	Literal struct {
+		span
+		Kind TokenKind
+		Text string
+	}
+
+	// "..." or ''...'' string
+	StringLit struct {
+		span
+		Indented bool
+		Parts    []Node
+	}
+
+	// Literal chunk of a string, still escaped
+	StringText struct {
+		span
+		Raw string
+	}
+
+	// ${ ... } inside strings, paths and attribute names
+	Interpolation struct {
+		span
+		Expr Node
+	}
+
+	// Path containing interpolations
+	InterpPath struct {
+		span
+		Parts []Node
+	}
+
+	List struct {
+		span
+		Elems []Node
+	}
+
+	AttrSet struct {
+		span
+		Rec      bool
+		Bindings []Binding
+	}
+
+	Let struct {
+		span
+		Bindings []Binding
+		Body     Node
+	}
+
+	With struct {
+		span
+		Env  Node
+		Body Node
+	}
+
+	Assert struct {
+		span
+		Cond Node
+		Body Node
+	}
+
+	If struct {
+		span
+		Cond Node
+		Then Node
+		Else Node
+	}
+
+	Lambda struct {
+		span
+		Arg     *Identifier
+		Formals *Formals
+		Body    Node
+	}
+
+	Formals struct {
+		span
+		Params   []*Formal
+		Ellipsis bool
+	}
+
+	Formal struct {
+		span
+		Name    *Identifier
+		Default Node
+	}
+
+	Apply struct {
+		span
+		Func Node
+		Arg  Node
+	}
+
+	Select struct {
+		span
+		Expr    Node
+		Path    []Node
+		Default Node
+	}
+
+	HasAttr struct {
+		span
+		Expr Node
+		Path []Node
+	}
+
+	BinaryOp struct {
+		span
+		Op    TokenKind
+		Left  Node
+		Right Node
+	}
+
+	UnaryOp struct {
+		span
+		Op   TokenKind
+		Expr Node
+	}
+
+	Paren struct {
+		span
+		Expr Node
+	}
+)
+
+// Binding inside an attrset or let block
+type Binding interface {
+	Node
+	binding()
+}
+
+type (
+	// a.b.c = value;
+	Attr struct {
+		span
+		Path  []Node
+		Value Node
+	}
+
+	// inherit a b; or inherit (x) a b;
+	Inherit struct {
+		span
+		From  Node
+		Names []Node
+	}
+)
+
+func (*Attr) binding()    {}
+func (*Inherit) binding() {}
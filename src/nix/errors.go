@@ -0,0 +1,33 @@
+package nix
+
+import "fmt"
+
+// Syntax error with a 1-based line and column
+type Error struct {
+	Pos  int
+	Line int
+	Col  int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Col, e.Msg)
+}
+
+func newError(src []byte, pos int, format string, args ...interface{}) error {
+	line, col := lineCol(src, pos)
+	return &Error{Pos: pos, Line: line, Col: col, Msg: fmt.Sprintf(format, args...)}
+}
+
+func lineCol(src []byte, pos int) (int, int) {
+	line, col := 1, 1
+	for i := 0; i < pos && i < len(src); i++ {
+		if src[i] == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return line, col
+}
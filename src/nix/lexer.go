@@ -0,0 +1,428 @@
+package nix
+
+type lexer struct {
+	src []byte
+	pos int
+	end int
+
+	// Interpolations found by the last matchPath
+	interps []Span
+}
+
+// Tokenize src[start:end], keeping absolute offsets
+func lex(src []byte, start, end int) ([]Token, error) {
+	l := &lexer{src: src, pos: start, end: end}
+	var tokens []Token
+	for {
+		tok, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, tok)
+		if tok.Kind == TokEOF {
+			return tokens, nil
+		}
+	}
+}
+
+func (l *lexer) errorf(pos int, format string, args ...interface{}) error {
+	return newError(l.src, pos, format, args...)
+}
+
+func (l *lexer) peek(offset int) byte {
+	if l.pos+offset < l.end {
+		return l.src[l.pos+offset]
+	}
+	return 0
+}
+
+// Skip whitespace and comments
+func (l *lexer) skipTrivia() error {
+	for l.pos < l.end {
+		c := l.src[l.pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			l.pos++
+		case c == '#':
+			for l.pos < l.end && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case c == '/' && l.peek(1) == '*':
+			start := l.pos
+			l.pos += 2
+			for {
+				if l.pos+1 >= l.end {
+					return l.errorf(start, "unterminated comment")
+				}
+				if l.src[l.pos] == '*' && l.src[l.pos+1] == '/' {
+					l.pos += 2
+					break
+				}
+				l.pos++
+			}
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (l *lexer) next() (Token, error) {
+	if err := l.skipTrivia(); err != nil {
+		return Token{}, err
+	}
+	start := l.pos
+	if l.pos >= l.end {
+		return Token{Kind: TokEOF, Pos: start, End: start}, nil
+	}
+	c := l.src[l.pos]
+
+	switch {
+	case c == '"':
+		return l.scanString()
+	case c == '\'' && l.peek(1) == '\'':
+		return l.scanIndString()
+	}
+
+	if end, ok := l.matchSearchPath(); ok {
+		return l.token(TokSearchPath, start, end), nil
+	}
+	if ok, err := l.matchPath(); err != nil {
+		return Token{}, err
+	} else if ok {
+		tok := l.token(TokPath, start, l.pos)
+		tok.Interps = l.takeInterps()
+		return tok, nil
+	}
+	if end, ok := l.matchURI(); ok {
+		return l.token(TokURI, start, end), nil
+	}
+
+	switch {
+	case isIdentStart(c):
+		end := l.pos + 1
+		for end < l.end && isIdentChar(l.src[end]) {
+			end++
+		}
+		tok := l.token(TokIdent, start, end)
+		if kw, ok := keywords[tok.Text]; ok {
+			tok.Kind = kw
+		}
+		return tok, nil
+	case isDigit(c):
+		return l.scanNumber(), nil
+	}
+
+	// Operators and punctuation, longest match first
+	ops := []struct {
+		text string
+		kind TokenKind
+	}{
+		{"...", TokEllipsis},
+		{"${", TokDollarCurly},
+		{"++", TokConcat},
+		{"//", TokUpdate},
+		{"==", TokEq},
+		{"!=", TokNotEq},
+		{"<=", TokLessEq},
+		{">=", TokGreaterEq},
+		{"&&", TokAnd},
+		{"||", TokOrOp},
+		{"->", TokImplies},
+		{"{", TokLBrace},
+		{"}", TokRBrace},
+		{"[", TokLBracket},
+		{"]", TokRBracket},
+		{"(", TokLParen},
+		{")", TokRParen},
+		{";", TokSemicolon},
+		{":", TokColon},
+		{",", TokComma},
+		{".", TokDot},
+		{"@", TokAt},
+		{"=", TokAssign},
+		{"?", TokQuestion},
+		{"+", TokPlus},
+		{"-", TokMinus},
+		{"*", TokStar},
+		{"/", TokSlash},
+		{"<", TokLess},
+		{">", TokGreater},
+		{"!", TokNot},
+	}
+	for _, op := range ops {
+		if l.hasPrefix(op.text) {
+			return l.token(op.kind, start, start+len(op.text)), nil
+		}
+	}
+	return Token{}, l.errorf(start, "unexpected character %q", c)
+}
+
+func (l *lexer) token(kind TokenKind, start, end int) Token {
+	l.pos = end
+	return Token{Kind: kind, Pos: start, End: end, Text: string(l.src[start:end])}
+}
+
+func (l *lexer) hasPrefix(s string) bool {
+	if l.pos+len(s) > l.end {
+		return false
+	}
+	return string(l.src[l.pos:l.pos+len(s)]) == s
+}
+
+func (l *lexer) takeInterps() []Span {
+	interps := l.interps
+	l.interps = nil
+	return interps
+}
+
+func (l *lexer) scanNumber() Token {
+	start := l.pos
+	end := l.pos
+	for end < l.end && isDigit(l.src[end]) {
+		end++
+	}
+	kind := TokInt
+	if end+1 < l.end && l.src[end] == '.' && isDigit(l.src[end+1]) {
+		kind = TokFloat
+		end++
+		for end < l.end && isDigit(l.src[end]) {
+			end++
+		}
+		if end < l.end && (l.src[end] == 'e' || l.src[end] == 'E') {
+			e := end + 1
+			if e < l.end && (l.src[e] == '+' || l.src[e] == '-') {
+				e++
+			}
+			if e < l.end && isDigit(l.src[e]) {
+				end = e
+				for end < l.end && isDigit(l.src[end]) {
+					end++
+				}
+			}
+		}
+	}
+	return l.token(kind, start, end)
+}
+
+// Scan "..." strings
+func (l *lexer) scanString() (Token, error) {
+	start := l.pos
+	l.pos++
+	var interps []Span
+	for {
+		if l.pos >= l.end {
+			return Token{}, l.errorf(start, "unterminated string")
+		}
+		c := l.src[l.pos]
+		switch {
+		case c == '"':
+			l.pos++
+			tok := l.token(TokString, start, l.pos)
+			tok.Interps = interps
+			return tok, nil
+		case c == '\\':
+			l.pos += 2
+		case c == '$' && l.peek(1) == '$':
+			l.pos += 2
+		case c == '$' && l.peek(1) == '{':
+			span, err := l.scanInterp()
+			if err != nil {
+				return Token{}, err
+			}
+			interps = append(interps, span)
+		default:
+			l.pos++
+		}
+	}
+}
+
+// Scan indented strings:
+//
+//	''...''
+func (l *lexer) scanIndString() (Token, error) {
+	start := l.pos
+	l.pos += 2
+	var interps []Span
+	for {
+		if l.pos >= l.end {
+			return Token{}, l.errorf(start, "unterminated indented string")
+		}
+		c := l.src[l.pos]
+		switch {
+		case c == '\'' && l.peek(1) == '\'':
+			switch l.peek(2) {
+			case '\'', '$':
+				l.pos += 3
+			case '\\':
+				l.pos += 4
+			default:
+				l.pos += 2
+				tok := l.token(TokIndString, start, l.pos)
+				tok.Interps = interps
+				return tok, nil
+			}
+		case c == '$' && l.peek(1) == '$':
+			l.pos += 2
+		case c == '$' && l.peek(1) == '{':
+			span, err := l.scanInterp()
+			if err != nil {
+				return Token{}, err
+			}
+			interps = append(interps, span)
+		default:
+			l.pos++
+		}
+	}
+}
+
+// Skip a ${ ... } interpolation, returning the span of its contents
+func (l *lexer) scanInterp() (Span, error) {
+	open := l.pos
+	l.pos += 2
+	span := Span{Start: l.pos}
+	depth := 1
+	for {
+		tok, err := l.next()
+		if err != nil {
+			return Span{}, err
+		}
+		switch tok.Kind {
+		case TokEOF:
+			return Span{}, l.errorf(open, "unterminated interpolation")
+		case TokLBrace, TokDollarCurly:
+			depth++
+		case TokRBrace:
+			depth--
+			if depth == 0 {
+				span.End = tok.Pos
+				return span, nil
+			}
+		}
+	}
+}
+
+// Match <nixpkgs> style paths
+func (l *lexer) matchSearchPath() (int, bool) {
+	if l.src[l.pos] != '<' {
+		return 0, false
+	}
+	i := l.pos + 1
+	segStart := i
+	for i < l.end {
+		c := l.src[i]
+		switch {
+		case isPathChar(c):
+			i++
+		case c == '/' && i > segStart:
+			i++
+			segStart = i
+		case c == '>' && i > segStart:
+			return i + 1, true
+		default:
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// Match ./foo, /foo, foo/bar, ~/foo and paths with interpolations
+func (l *lexer) matchPath() (bool, error) {
+	i := l.pos
+	if l.src[i] == '~' {
+		i++
+		if i >= l.end || l.src[i] != '/' {
+			return false, nil
+		}
+	} else {
+		for i < l.end && isPathChar(l.src[i]) {
+			i++
+		}
+	}
+	// A path needs a slash followed by a path segment
+	if i+1 >= l.end || l.src[i] != '/' {
+		return false, nil
+	}
+	if !isPathChar(l.src[i+1]) && !(l.src[i+1] == '$' && i+2 < l.end && l.src[i+2] == '{') {
+		return false, nil
+	}
+
+	start := l.pos
+	l.pos = i
+	var interps []Span
+	for l.pos < l.end {
+		c := l.src[l.pos]
+		switch {
+		case isPathChar(c):
+			l.pos++
+		case c == '/' && l.pos+1 < l.end && (isPathChar(l.src[l.pos+1]) || l.src[l.pos+1] == '$'):
+			l.pos++
+		case c == '$' && l.peek(1) == '{':
+			span, err := l.scanInterp()
+			if err != nil {
+				return false, err
+			}
+			interps = append(interps, span)
+		default:
+			l.interps = interps
+			return l.pos > start, nil
+		}
+	}
+	l.interps = interps
+	return true, nil
+}
+
+// Match unquoted URIs like https://example.org
+func (l *lexer) matchURI() (int, bool) {
+	i := l.pos
+	if !isAlpha(l.src[i]) {
+		return 0, false
+	}
+	i++
+	for i < l.end && (isAlpha(l.src[i]) || isDigit(l.src[i]) || l.src[i] == '+' || l.src[i] == '-' || l.src[i] == '.') {
+		i++
+	}
+	if i >= l.end || l.src[i] != ':' {
+		return 0, false
+	}
+	i++
+	rest := i
+	for i < l.end && isURIChar(l.src[i]) {
+		i++
+	}
+	if i == rest {
+		return 0, false
+	}
+	return i, true
+}
+
+func isAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return isAlpha(c) || c == '_'
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || isDigit(c) || c == '\'' || c == '-'
+}
+
+func isPathChar(c byte) bool {
+	return isAlpha(c) || isDigit(c) || c == '.' || c == '_' || c == '-' || c == '+'
+}
+
+func isURIChar(c byte) bool {
+	if isAlpha(c) || isDigit(c) {
+		return true
+	}
+	switch c {
+	case '%', '/', '?', ':', '@', '&', '=', '+', '$', ',', '-', '_', '.', '!', '~', '*', '\'':
+		return true
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+package nix
+
+import "strings"
+
+// A list bound to an attribute path
+type ListMatch struct {
+	// The binding the list belongs to
+	Attr *Attr
+	// Full attribute path of the binding, including enclosing attrsets
+	Path string
+	List *List
+	// Environment of an enclosing `with <env>;`, nil if none
+	With Node
+	// Inside lib.optionals, lib.mkIf and friends
+	Conditional bool
+}
+
+// Find the lists assigned to an attribute path such as "home.packages".
+//
+// Nested attrsets (home = { packages = ...; }), deeper prefixes
+// (home-manager.users.me.home.packages), `with pkgs;`, `++` concatenations
+// and lib.optionals/lib.mkIf wrappers are all understood.
+func FindLists(f *File, attrPath string) []ListMatch {
+	want := strings.Split(attrPath, ".")
+	var matches []ListMatch
+	var walk func(n Node, prefix []string)
+	walk = func(n Node, prefix []string) {
+		switch n := n.(type) {
+		case *AttrSet:
+			for _, b := range n.Bindings {
+				attr, ok := b.(*Attr)
+				if !ok {
+					walk(b, prefix)
+					continue
+				}
+				path := append(append([]string{}, prefix...), AttrNames(attr.Path)...)
+				if hasSuffix(path, want) {
+					for _, m := range collectLists(attr.Value, nil, false) {
+						m.Attr = attr
+						m.Path = strings.Join(path, ".")
+						matches = append(matches, m)
+					}
+				}
+				walk(attr.Value, path)
+			}
+		case *Let:
+			// Let bindings are local variables, not options
+			for _, b := range n.Bindings {
+				if attr, ok := b.(*Attr); ok {
+					walk(attr.Value, nil)
+				}
+			}
+			walk(n.Body, prefix)
+		default:
+			for _, c := range Children(n) {
+				walk(c, prefix)
+			}
+		}
+	}
+	walk(f.Root, nil)
+	return matches
+}
+
+func hasSuffix(path, suffix []string) bool {
+	if len(suffix) > len(path) {
+		return false
+	}
+	offset := len(path) - len(suffix)
+	for i, s := range suffix {
+		if path[offset+i] != s {
+			return false
+		}
+	}
+	return true
+}
+
+// Wrappers whose last argument is the value itself
+var passThroughFuncs = map[string]bool{
+	"optionals":       true,
+	"mkIf":            true,
+	"mkBefore":        true,
+	"mkAfter":         true,
+	"mkDefault":       true,
+	"mkForce":         true,
+	"mkOverride":      true,
+	"mkOrder":         true,
+	"mkOptionDefault": true,
+}
+
+var conditionalFuncs = map[string]bool{
+	"optionals": true,
+	"mkIf":      true,
+}
+
+// Lists making up the value of a binding
+func collectLists(n Node, env Node, conditional bool) []ListMatch {
+	switch n := n.(type) {
+	case *List:
+		return []ListMatch{{List: n, With: env, Conditional: conditional}}
+	case *With:
+		return collectLists(n.Body, n.Env, conditional)
+	case *Paren:
+		return collectLists(n.Expr, env, conditional)
+	case *BinaryOp:
+		if n.Op != TokConcat {
+			return nil
+		}
+		return append(collectLists(n.Left, env, conditional), collectLists(n.Right, env, conditional)...)
+	case *If:
+		return append(collectLists(n.Then, env, true), collectLists(n.Else, env, true)...)
+	case *Let:
+		return collectLists(n.Body, env, conditional)
+	case *Apply:
+		fn, args := FlattenApply(n)
+		name := FuncName(fn)
+		switch {
+		case passThroughFuncs[name] && len(args) > 0:
+			return collectLists(args[len(args)-1], env, conditional || conditionalFuncs[name])
+		case name == "mkMerge" && len(args) == 1:
+			list, ok := args[0].(*List)
+			if !ok {
+				return nil
+			}
+			var out []ListMatch
+			for _, e := range list.Elems {
+				out = append(out, collectLists(e, env, conditional)...)
+			}
+			return out
+		}
+	}
+	return nil
+}
+
+// Split f a b c into f and [a b c]
+func FlattenApply(n *Apply) (Node, []Node) {
+	var args []Node
+	var fn Node = n
+	for {
+		app, ok := fn.(*Apply)
+		if !ok {
+			break
+		}
+		args = append([]Node{app.Arg}, args...)
+		fn = app.Func
+	}
+	return fn, args
+}
+
+// Last name of a function reference: lib.mkIf -> mkIf
+func FuncName(fn Node) string {
+	switch fn := fn.(type) {
+	case *Identifier:
+		return fn.Name
+	case *Select:
+		if fn.Default == nil && len(fn.Path) > 0 {
+			name, _ := AttrName(fn.Path[len(fn.Path)-1])
+			return name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,611 @@
+package nix
+
+import "os"
+
+// Parsed Nix source
+type File struct {
+	Src  []byte
+	Root Node
+}
+
+// Parse a Nix expression
+func Parse(src []byte) (*File, error) {
+	root, err := parseRange(src, 0, len(src))
+	if err != nil {
+		return nil, err
+	}
+	return &File{Src: src, Root: root}, nil
+}
+
+// Read and parse a .nix file
+func ParseFile(path string) (*File, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(src)
+}
+
+// Source text of a node
+func (f *File) Text(n Node) string {
+	return string(f.Src[n.Pos():n.End()])
+}
+
+// 1-based line and column of an offset
+func (f *File) Position(offset int) (int, int) {
+	return lineCol(f.Src, offset)
+}
+
+type parser struct {
+	src  []byte
+	toks []Token
+	i    int
+}
+
+func parseRange(src []byte, start, end int) (Node, error) {
+	toks, err := lex(src, start, end)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{src: src, toks: toks}
+	expr, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.cur().Kind != TokEOF {
+		return nil, p.unexpected()
+	}
+	return expr, nil
+}
+
+func (p *parser) cur() Token {
+	return p.peek(0)
+}
+
+func (p *parser) peek(n int) Token {
+	if p.i+n < len(p.toks) {
+		return p.toks[p.i+n]
+	}
+	return p.toks[len(p.toks)-1]
+}
+
+func (p *parser) advance() Token {
+	tok := p.cur()
+	if p.i < len(p.toks)-1 {
+		p.i++
+	}
+	return tok
+}
+
+func (p *parser) expect(kind TokenKind) (Token, error) {
+	tok := p.cur()
+	if tok.Kind != kind {
+		return tok, newError(p.src, tok.Pos, "expected %s, found %s", kind, tok.Kind)
+	}
+	return p.advance(), nil
+}
+
+func (p *parser) unexpected() error {
+	tok := p.cur()
+	return newError(p.src, tok.Pos, "unexpected %s", tok.Kind)
+}
+
+func (p *parser) parseExpr() (Node, error) {
+	tok := p.cur()
+	switch tok.Kind {
+	case TokIdent:
+		switch p.peek(1).Kind {
+		case TokColon:
+			return p.parseLambda()
+		case TokAt:
+			if p.peek(2).Kind == TokLBrace {
+				return p.parseLambda()
+			}
+		}
+	case TokLBrace:
+		if p.isFormals() {
+			return p.parseLambda()
+		}
+	case TokLet:
+		if p.peek(1).Kind != TokLBrace {
+			return p.parseLet()
+		}
+	case TokWith:
+		p.advance()
+		env, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(TokSemicolon); err != nil {
+			return nil, err
+		}
+		body, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return &With{span: span{tok.Pos, body.End()}, Env: env, Body: body}, nil
+	case TokAssert:
+		p.advance()
+		cond, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(TokSemicolon); err != nil {
+			return nil, err
+		}
+		body, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return &Assert{span: span{tok.Pos, body.End()}, Cond: cond, Body: body}, nil
+	case TokIf:
+		p.advance()
+		cond, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(TokThen); err != nil {
+			return nil, err
+		}
+		then, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(TokElse); err != nil {
+			return nil, err
+		}
+		els, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return &If{span: span{tok.Pos, els.End()}, Cond: cond, Then: then, Else: els}, nil
+	}
+	return p.parseBinary(1)
+}
+
+// Decide whether '{' starts a lambda pattern rather than an attrset
+func (p *parser) isFormals() bool {
+	switch p.peek(1).Kind {
+	case TokRBrace:
+		next := p.peek(2).Kind
+		return next == TokColon || next == TokAt
+	case TokEllipsis:
+		return true
+	case TokIdent:
+		switch p.peek(2).Kind {
+		case TokComma, TokQuestion:
+			return true
+		case TokRBrace:
+			next := p.peek(3).Kind
+			return next == TokColon || next == TokAt
+		}
+	}
+	return false
+}
+
+func (p *parser) parseLambda() (Node, error) {
+	start := p.cur().Pos
+	lambda := &Lambda{}
+	if p.cur().Kind == TokIdent {
+		tok := p.advance()
+		lambda.Arg = &Identifier{span: span{tok.Pos, tok.End}, Name: tok.Text}
+		if p.cur().Kind == TokAt {
+			p.advance()
+			formals, err := p.parseFormals()
+			if err != nil {
+				return nil, err
+			}
+			lambda.Formals = formals
+		}
+	} else {
+		formals, err := p.parseFormals()
+		if err != nil {
+			return nil, err
+		}
+		lambda.Formals = formals
+		if p.cur().Kind == TokAt {
+			p.advance()
+			tok, err := p.expect(TokIdent)
+			if err != nil {
+				return nil, err
+			}
+			lambda.Arg = &Identifier{span: span{tok.Pos, tok.End}, Name: tok.Text}
+		}
+	}
+	if _, err := p.expect(TokColon); err != nil {
+		return nil, err
+	}
+	body, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	lambda.Body = body
+	lambda.span = span{start, body.End()}
+	return lambda, nil
+}
+
+func (p *parser) parseFormals() (*Formals, error) {
+	open, err := p.expect(TokLBrace)
+	if err != nil {
+		return nil, err
+	}
+	formals := &Formals{}
+	for p.cur().Kind != TokRBrace {
+		if p.cur().Kind == TokEllipsis {
+			p.advance()
+			formals.Ellipsis = true
+		} else {
+			tok, err := p.expect(TokIdent)
+			if err != nil {
+				return nil, err
+			}
+			formal := &Formal{span: span{tok.Pos, tok.End}}
+			formal.Name = &Identifier{span: span{tok.Pos, tok.End}, Name: tok.Text}
+			if p.cur().Kind == TokQuestion {
+				p.advance()
+				def, err := p.parseExpr()
+				if err != nil {
+					return nil, err
+				}
+				formal.Default = def
+				formal.end = def.End()
+			}
+			formals.Params = append(formals.Params, formal)
+		}
+		if p.cur().Kind != TokComma {
+			break
+		}
+		p.advance()
+	}
+	close, err := p.expect(TokRBrace)
+	if err != nil {
+		return nil, err
+	}
+	formals.span = span{open.Pos, close.End}
+	return formals, nil
+}
+
+func (p *parser) parseLet() (Node, error) {
+	start := p.advance().Pos
+	bindings, err := p.parseBindings(TokIn)
+	if err != nil {
+		return nil, err
+	}
+	p.advance()
+	body, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	return &Let{span: span{start, body.End()}, Bindings: bindings, Body: body}, nil
+}
+
+type opInfo struct {
+	prec  int
+	right bool
+}
+
+// Binary operator precedence, higher binds tighter
+var binaryOps = map[TokenKind]opInfo{
+	TokImplies:   {1, true},
+	TokOrOp:      {2, false},
+	TokAnd:       {3, false},
+	TokEq:        {4, false},
+	TokNotEq:     {4, false},
+	TokLess:      {5, false},
+	TokLessEq:    {5, false},
+	TokGreater:   {5, false},
+	TokGreaterEq: {5, false},
+	TokUpdate:    {6, true},
+	TokPlus:      {8, false},
+	TokMinus:     {8, false},
+	TokStar:      {9, false},
+	TokSlash:     {9, false},
+	TokConcat:    {10, true},
+	TokQuestion:  {11, false},
+}
+
+const notPrec = 7
+
+func (p *parser) parseBinary(minPrec int) (Node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.cur()
+		info, ok := binaryOps[op.Kind]
+		if !ok || info.prec < minPrec {
+			return left, nil
+		}
+		p.advance()
+		if op.Kind == TokQuestion {
+			path, err := p.parseAttrPath()
+			if err != nil {
+				return nil, err
+			}
+			left = &HasAttr{span: span{left.Pos(), path[len(path)-1].End()}, Expr: left, Path: path}
+			continue
+		}
+		next := info.prec + 1
+		if info.right {
+			next = info.prec
+		}
+		right, err := p.parseBinary(next)
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryOp{span: span{left.Pos(), right.End()}, Op: op.Kind, Left: left, Right: right}
+	}
+}
+
+func (p *parser) parseUnary() (Node, error) {
+	tok := p.cur()
+	switch tok.Kind {
+	case TokNot:
+		p.advance()
+		expr, err := p.parseBinary(notPrec + 1)
+		if err != nil {
+			return nil, err
+		}
+		return &UnaryOp{span: span{tok.Pos, expr.End()}, Op: TokNot, Expr: expr}, nil
+	case TokMinus:
+		p.advance()
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &UnaryOp{span: span{tok.Pos, expr.End()}, Op: TokMinus, Expr: expr}, nil
+	}
+	return p.parseApply()
+}
+
+func (p *parser) parseApply() (Node, error) {
+	fn, err := p.parseSelect()
+	if err != nil {
+		return nil, err
+	}
+	for p.startsSimple() {
+		arg, err := p.parseSelect()
+		if err != nil {
+			return nil, err
+		}
+		fn = &Apply{span: span{fn.Pos(), arg.End()}, Func: fn, Arg: arg}
+	}
+	return fn, nil
+}
+
+func (p *parser) startsSimple() bool {
+	switch p.cur().Kind {
+	case TokIdent, TokInt, TokFloat, TokPath, TokSearchPath, TokURI, TokString, TokIndString, TokLParen, TokLBrace, TokLBracket, TokRec:
+		return true
+	}
+	return false
+}
+
+func (p *parser) parseSelect() (Node, error) {
+	expr, err := p.parseSimple()
+	if err != nil {
+		return nil, err
+	}
+	if p.cur().Kind != TokDot {
+		return expr, nil
+	}
+	p.advance()
+	path, err := p.parseAttrPath()
+	if err != nil {
+		return nil, err
+	}
+	sel := &Select{span: span{expr.Pos(), path[len(path)-1].End()}, Expr: expr, Path: path}
+	if p.cur().Kind == TokOr {
+		p.advance()
+		def, err := p.parseSelect()
+		if err != nil {
+			return nil, err
+		}
+		sel.Default = def
+		sel.end = def.End()
+	}
+	return sel, nil
+}
+
+func (p *parser) parseSimple() (Node, error) {
+	tok := p.cur()
+	switch tok.Kind {
+	case TokIdent:
+		p.advance()
+		return &Identifier{span: span{tok.Pos, tok.End}, Name: tok.Text}, nil
+	case TokInt, TokFloat, TokURI, TokSearchPath:
+		p.advance()
+		return &Literal{span: span{tok.Pos, tok.End}, Kind: tok.Kind, Text: tok.Text}, nil
+	case TokPath:
+		p.advance()
+		if len(tok.Interps) == 0 {
+			return &Literal{span: span{tok.Pos, tok.End}, Kind: TokPath, Text: tok.Text}, nil
+		}
+		parts, err := p.parseParts(tok, tok.Pos, tok.End)
+		if err != nil {
+			return nil, err
+		}
+		return &InterpPath{span: span{tok.Pos, tok.End}, Parts: parts}, nil
+	case TokString:
+		p.advance()
+		parts, err := p.parseParts(tok, tok.Pos+1, tok.End-1)
+		if err != nil {
+			return nil, err
+		}
+		return &StringLit{span: span{tok.Pos, tok.End}, Parts: parts}, nil
+	case TokIndString:
+		p.advance()
+		parts, err := p.parseParts(tok, tok.Pos+2, tok.End-2)
+		if err != nil {
+			return nil, err
+		}
+		return &StringLit{span: span{tok.Pos, tok.End}, Indented: true, Parts: parts}, nil
+	case TokLParen:
+		p.advance()
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		close, err := p.expect(TokRParen)
+		if err != nil {
+			return nil, err
+		}
+		return &Paren{span: span{tok.Pos, close.End}, Expr: expr}, nil
+	case TokLBracket:
+		p.advance()
+		list := &List{}
+		for p.cur().Kind != TokRBracket {
+			if p.cur().Kind == TokEOF {
+				return nil, newError(p.src, tok.Pos, "unclosed list")
+			}
+			elem, err := p.parseSelect()
+			if err != nil {
+				return nil, err
+			}
+			list.Elems = append(list.Elems, elem)
+		}
+		close := p.advance()
+		list.span = span{tok.Pos, close.End}
+		return list, nil
+	case TokRec:
+		p.advance()
+		set, err := p.parseAttrSet()
+		if err != nil {
+			return nil, err
+		}
+		set.Rec = true
+		set.start = tok.Pos
+		return set, nil
+	case TokLBrace:
+		return p.parseAttrSet()
+	}
+	return nil, p.unexpected()
+}
+
+// Split a string or path token into text and interpolations
+func (p *parser) parseParts(tok Token, start, end int) ([]Node, error) {
+	var parts []Node
+	pos := start
+	for _, in := range tok.Interps {
+		open := in.Start - 2
+		if open > pos {
+			parts = append(parts, &StringText{span: span{pos, open}, Raw: string(p.src[pos:open])})
+		}
+		expr, err := parseRange(p.src, in.Start, in.End)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, &Interpolation{span: span{open, in.End + 1}, Expr: expr})
+		pos = in.End + 1
+	}
+	if end > pos {
+		parts = append(parts, &StringText{span: span{pos, end}, Raw: string(p.src[pos:end])})
+	}
+	return parts, nil
+}
+
+func (p *parser) parseAttrSet() (*AttrSet, error) {
+	open, err := p.expect(TokLBrace)
+	if err != nil {
+		return nil, err
+	}
+	bindings, err := p.parseBindings(TokRBrace)
+	if err != nil {
+		return nil, err
+	}
+	close := p.advance()
+	return &AttrSet{span: span{open.Pos, close.End}, Bindings: bindings}, nil
+}
+
+// Parse bindings up to (not including) the terminator
+func (p *parser) parseBindings(terminator TokenKind) ([]Binding, error) {
+	var bindings []Binding
+	for p.cur().Kind != terminator {
+		tok := p.cur()
+		switch tok.Kind {
+		case TokEOF:
+			return nil, newError(p.src, tok.Pos, "expected %s, found %s", terminator, tok.Kind)
+		case TokInherit:
+			p.advance()
+			inherit := &Inherit{}
+			if p.cur().Kind == TokLParen {
+				p.advance()
+				from, err := p.parseExpr()
+				if err != nil {
+					return nil, err
+				}
+				if _, err := p.expect(TokRParen); err != nil {
+					return nil, err
+				}
+				inherit.From = from
+			}
+			for p.cur().Kind != TokSemicolon {
+				name, err := p.parseAttrName()
+				if err != nil {
+					return nil, err
+				}
+				inherit.Names = append(inherit.Names, name)
+			}
+			semi := p.advance()
+			inherit.span = span{tok.Pos, semi.End}
+			bindings = append(bindings, inherit)
+		default:
+			path, err := p.parseAttrPath()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expect(TokAssign); err != nil {
+				return nil, err
+			}
+			value, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			semi, err := p.expect(TokSemicolon)
+			if err != nil {
+				return nil, err
+			}
+			bindings = append(bindings, &Attr{span: span{tok.Pos, semi.End}, Path: path, Value: value})
+		}
+	}
+	return bindings, nil
+}
+
+func (p *parser) parseAttrPath() ([]Node, error) {
+	var path []Node
+	for {
+		name, err := p.parseAttrName()
+		if err != nil {
+			return nil, err
+		}
+		path = append(path, name)
+		if p.cur().Kind != TokDot {
+			return path, nil
+		}
+		p.advance()
+	}
+}
+
+func (p *parser) parseAttrName() (Node, error) {
+	tok := p.cur()
+	switch tok.Kind {
+	case TokIdent, TokOr:
+		p.advance()
+		return &Identifier{span: span{tok.Pos, tok.End}, Name: tok.Text}, nil
+	case TokString:
+		return p.parseSimple()
+	case TokDollarCurly:
+		p.advance()
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		close, err := p.expect(TokRBrace)
+		if err != nil {
+			return nil, err
+		}
+		return &Interpolation{span: span{tok.Pos, close.End}, Expr: expr}, nil
+	}
+	return nil, p.unexpected()
+}
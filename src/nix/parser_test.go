@@ -0,0 +1,207 @@
+package nix
+
+import (
+	"strings"
+	"testing"
+)
+
+func mustParse(t *testing.T, src string) *File {
+	t.Helper()
+	f, err := Parse([]byte(src))
+	if err != nil {
+		t.Fatalf("Parse(%q): %v", src, err)
+	}
+	return f
+}
+
+// List elements as source text
+func elemTexts(f *File, l *List) []string {
+	var out []string
+	for _, e := range l.Elems {
+		out = append(out, f.Text(e))
+	}
+	return out
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"module", "{ config, pkgs, ... }:\n\n{\n  # packages\n  environment.systemPackages = with pkgs; [\n    git # vcs\n    htop\n  ];\n}\n"},
+		{"flake", "{\n  inputs.nixpkgs.url = \"github:NixOS/nixpkgs/nixos-24.11\";\n  outputs = { self, nixpkgs, ... }@inputs: {\n    nixosConfigurations.laptop = nixpkgs.lib.nixosSystem {\n      modules = [ ./configuration.nix ];\n    };\n  };\n}\n"},
+		{"let", "let\n  a = 1;\n  b = rec { c = a + 2; };\nin\nb.c or 0\n"},
+		{"strings", "{ a = \"x ${y} \\\"z\\\"\"; b = ''\n    line ''${not}\n  ''; }"},
+		{"comments", "/* head */ [ /* in */ a # tail\n  b ]"},
+		{"operators", "if a && !b then x ++ [ y ] else x // { z = -1; }"},
+		{"tabs", "{\n\thome.packages = [\n\t\tpkgs.git\n\t];\n}\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := mustParse(t, tt.src)
+			out, err := NewRewriter(f).Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != tt.src {
+				t.Errorf("round trip changed the source:\n%s", out)
+			}
+		})
+	}
+}
+
+func TestFindLists(t *testing.T) {
+	tests := []struct {
+		name        string
+		src         string
+		path        string
+		elems       [][]string
+		with        string
+		conditional bool
+	}{
+		{
+			name:  "plain",
+			src:   "{ home.packages = [ pkgs.git pkgs.htop ]; }",
+			path:  "home.packages",
+			elems: [][]string{{"pkgs.git", "pkgs.htop"}},
+		},
+		{
+			name:  "with pkgs",
+			src:   "{ pkgs, ... }: { environment.systemPackages = with pkgs; [ git htop ]; }",
+			path:  "environment.systemPackages",
+			elems: [][]string{{"git", "htop"}},
+			with:  "pkgs",
+		},
+		{
+			name:  "nested attrsets",
+			src:   "{ home = { packages = [ a ]; }; }",
+			path:  "home.packages",
+			elems: [][]string{{"a"}},
+		},
+		{
+			name:  "deeper prefix",
+			src:   "{ home-manager.users.me.home.packages = [ a ]; }",
+			path:  "home.packages",
+			elems: [][]string{{"a"}},
+		},
+		{
+			name:  "quoted attrs",
+			src:   "{ home.packages = [ pkgs.\"3proxy\" pkgs.git ]; }",
+			path:  "home.packages",
+			elems: [][]string{{`pkgs."3proxy"`, "pkgs.git"}},
+		},
+		{
+			name:  "quoted binding name",
+			src:   "{ \"home\".packages = [ a ]; }",
+			path:  "home.packages",
+			elems: [][]string{{"a"}},
+		},
+		{
+			name:  "comments inside",
+			src:   "{ home.packages = [\n  # editors\n  a /* b */\n  c # trailing\n]; }",
+			path:  "home.packages",
+			elems: [][]string{{"a", "c"}},
+		},
+		{
+			name:  "concatenation",
+			src:   "{ home.packages = [ a ] ++ [ b ]; }",
+			path:  "home.packages",
+			elems: [][]string{{"a"}, {"b"}},
+		},
+		{
+			name:        "mkIf",
+			src:         "{ home.packages = lib.mkIf cond [ a ]; }",
+			path:        "home.packages",
+			elems:       [][]string{{"a"}},
+			conditional: true,
+		},
+		{
+			name:  "let bindings are not options",
+			src:   "let home.packages = [ a ]; in { }",
+			path:  "home.packages",
+			elems: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := mustParse(t, tt.src)
+			matches := FindLists(f, tt.path)
+			if len(matches) != len(tt.elems) {
+				t.Fatalf("got %d lists, want %d", len(matches), len(tt.elems))
+			}
+			for i, m := range matches {
+				got := elemTexts(f, m.List)
+				if strings.Join(got, "|") != strings.Join(tt.elems[i], "|") {
+					t.Errorf("list %d: got %q, want %q", i, got, tt.elems[i])
+				}
+				with := ""
+				if id, ok := m.With.(*Identifier); ok {
+					with = id.Name
+				}
+				if with != tt.with {
+					t.Errorf("list %d: with %q, want %q", i, with, tt.with)
+				}
+				if m.Conditional != tt.conditional {
+					t.Errorf("list %d: conditional %v, want %v", i, m.Conditional, tt.conditional)
+				}
+			}
+		})
+	}
+}
+
+func TestStringValue(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+		ok   bool
+	}{
+		{"plain", `"hello"`, "hello", true},
+		{"escapes", `"a\"b\\c\nd\${e}"`, "a\"b\\c\nd${e}", true},
+		{"interpolation", `"a ${b}"`, "", false},
+		{"indented", "''\n    first\n      second\n  ''", "first\n  second\n", true},
+		{"indented escapes", "''\n  a '''quoted''' ''${b} ''\\n\n''", "a ''quoted'' ${b} \n\n", true},
+		{"indented interpolation", "''\n  ${a}\n''", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := mustParse(t, tt.src)
+			s, isString := f.Root.(*StringLit)
+			if !isString {
+				t.Fatalf("root is %T, want *StringLit", f.Root)
+			}
+			if s.Indented != strings.HasPrefix(tt.src, "''") {
+				t.Errorf("Indented = %v", s.Indented)
+			}
+			got, ok := s.Value()
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("Value() = %q, %v; want %q, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		line int
+	}{
+		{"unclosed list", "{\n  a = [ b\n}", 3},
+		{"missing semicolon", "{\n  a = 1\n  b = 2;\n}", 3},
+		{"unterminated string", "{ a = \"x; }", 1},
+		{"unterminated indented string", "{\n  a = ''\n  x;\n}", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.src))
+			perr, ok := err.(*Error)
+			if !ok {
+				t.Fatalf("got %v, want a *nix.Error", err)
+			}
+			if perr.Line != tt.line {
+				t.Errorf("error on line %d, want %d: %v", perr.Line, tt.line, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,310 @@
+package nix
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Text replacement of src[Start:End]
+type Edit struct {
+	Start int
+	End   int
+	Text  string
+}
+
+// Collects edits against a parsed file and applies them in one go,
+// leaving every byte outside the edited ranges untouched.
+type Rewriter struct {
+	file  *File
+	edits []Edit
+}
+
+func NewRewriter(f *File) *Rewriter {
+	return &Rewriter{file: f}
+}
+
+func (r *Rewriter) File() *File {
+	return r.file
+}
+
+func (r *Rewriter) Changed() bool {
+	return len(r.edits) > 0
+}
+
+func (r *Rewriter) Replace(start, end int, text string) {
+	r.edits = append(r.edits, Edit{Start: start, End: end, Text: text})
+}
+
+func (r *Rewriter) Insert(pos int, text string) {
+	r.Replace(pos, pos, text)
+}
+
+// Source with all edits applied; edits touching the same bytes are a
+// bug in the caller and give an error rather than a half-edited file
+func (r *Rewriter) Bytes() ([]byte, error) {
+	edits := append([]Edit{}, r.edits...)
+	// Inserts go before a replacement starting at the same offset
+	sort.SliceStable(edits, func(i, j int) bool {
+		if edits[i].Start != edits[j].Start {
+			return edits[i].Start < edits[j].Start
+		}
+		return edits[i].End < edits[j].End
+	})
+	src := r.file.Src
+	var b strings.Builder
+	pos := 0
+	for _, e := range edits {
+		if e.Start < pos {
+			line, col := r.file.Position(e.Start)
+			return nil, fmt.Errorf("overlapping edits at %d:%d", line, col)
+		}
+		b.Write(src[pos:e.Start])
+		b.WriteString(e.Text)
+		pos = e.End
+	}
+	b.Write(src[pos:])
+	return []byte(b.String()), nil
+}
+
+// Append items to a list, matching the indentation of its elements
+func (r *Rewriter) AppendToList(list *List, items ...string) {
+	if len(items) == 0 {
+		return
+	}
+	src := r.file.Src
+	open, close := list.Pos(), list.End()-1
+
+	if len(list.Elems) == 0 {
+		inner := string(src[open+1 : close])
+		if !strings.Contains(inner, "\n") {
+			r.appendInline(open, close, items)
+			return
+		}
+		indent := r.lineIndent(close) + r.IndentUnit()
+		if strings.TrimSpace(inner) == "" {
+			// Only whitespace inside, lay the list out afresh
+			r.Replace(open+1, lineStart(src, close), "\n"+joinLines(indent, items))
+			return
+		}
+		// Keep comments, add the items above the closing bracket
+		r.Insert(lineStart(src, close), joinLines(indent, items))
+		return
+	}
+
+	last := list.Elems[len(list.Elems)-1]
+	if r.sameLine(open, close) {
+		// Single-line list stays on one line
+		r.Insert(last.End(), " "+strings.Join(items, " "))
+		return
+	}
+
+	indent := r.elemIndent(list)
+	if r.startsLine(close) {
+		r.Insert(lineStart(src, close), joinLines(indent, items))
+		return
+	}
+	// Closing bracket shares the last element's line
+	r.Insert(last.End(), "\n"+strings.TrimSuffix(joinLines(indent, items), "\n"))
+}
+
+// Fill an empty one-line list or attrset: [ ] becomes [ item ], and
+// [ /* keep */ ] becomes [ /* keep */ item ]
+func (r *Rewriter) appendInline(open, close int, items []string) {
+	src := r.file.Src
+	text := strings.Join(items, " ") + " "
+	if strings.TrimSpace(string(src[open+1:close])) == "" {
+		r.Replace(open+1, close, " "+text)
+		return
+	}
+	if c := src[close-1]; c != ' ' && c != '\t' {
+		text = " " + text
+	}
+	r.Insert(close, text)
+}
+
+// Remove an element together with its line when it has the line to itself
+func (r *Rewriter) RemoveListElem(elem Node) {
+	start, end := r.lineSpan(elem)
+	r.Replace(start, end, "")
+}
+
+// Append bindings to an attrset, matching the indentation of the others
+func (r *Rewriter) AppendBindings(set *AttrSet, bindings ...string) {
+	if len(bindings) == 0 {
+		return
+	}
+	src := r.file.Src
+	open, close := set.Pos(), set.End()-1
+	for open < close && src[open] != '{' {
+		// Skip the rec keyword
+		open++
+	}
+
+	if len(set.Bindings) == 0 {
+		inner := string(src[open+1 : close])
+		if !strings.Contains(inner, "\n") {
+			r.appendInline(open, close, bindings)
+			return
+		}
+		indent := r.lineIndent(close) + r.IndentUnit()
+		r.Insert(lineStart(src, close), joinLines(indent, bindings))
+		return
+	}
+	r.InsertBindingsAfter(set.Bindings[len(set.Bindings)-1], bindings...)
+}
+
+// Insert bindings on the lines following an existing binding
+func (r *Rewriter) InsertBindingsAfter(after Binding, bindings ...string) {
+	src := r.file.Src
+	if r.sameLine(after.Pos(), after.End()) && !r.startsLine(after.Pos()) {
+		// { a = 1; b = 2; } stays on one line
+		r.Insert(after.End(), " "+strings.Join(bindings, " "))
+		return
+	}
+	indent := r.lineIndent(after.Pos())
+	end, blank := r.restOfLine(after.End())
+	if !blank {
+		// Something else follows on the line
+		r.Insert(after.End(), "\n"+strings.TrimSuffix(joinLines(indent, bindings), "\n"))
+		return
+	}
+	if end < len(src) {
+		end++
+	}
+	r.Insert(end, joinLines(indent, bindings))
+}
+
+// Replace a string literal's value, keeping its quoting style
+func (r *Rewriter) ReplaceString(s *StringLit, value string) {
+	if s.Indented {
+		r.Replace(s.Pos()+2, s.End()-2, escapeIndented(value))
+		return
+	}
+	r.Replace(s.Pos()+1, s.End()-1, Escape(value))
+}
+
+// Escape a value for use inside "..."
+func Escape(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "${", `\${`, "\n", `\n`, "\t", `\t`)
+	return replacer.Replace(value)
+}
+
+func escapeIndented(value string) string {
+	replacer := strings.NewReplacer("''", "'''", "${", "''${")
+	return replacer.Replace(value)
+}
+
+// Indentation step used by the file: a tab or a number of spaces
+func (r *Rewriter) IndentUnit() string {
+	return DetectIndentUnit(r.file.Src)
+}
+
+func DetectIndentUnit(src []byte) string {
+	tabs, spaces := 0, 0
+	counts := map[int]int{}
+	prev := 0
+	for _, line := range strings.Split(string(src), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		ws := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if strings.HasPrefix(ws, "\t") {
+			tabs++
+			continue
+		}
+		width := len(ws)
+		if width > 0 {
+			spaces++
+		}
+		if width > prev {
+			counts[width-prev]++
+		}
+		prev = width
+	}
+	if tabs > spaces {
+		return "\t"
+	}
+	best, bestCount := 2, 0
+	for step, n := range counts {
+		if n > bestCount || (n == bestCount && step < best) {
+			best, bestCount = step, n
+		}
+	}
+	return strings.Repeat(" ", best)
+}
+
+// Indentation of the elements of a multi-line list
+func (r *Rewriter) elemIndent(list *List) string {
+	for i := len(list.Elems) - 1; i >= 0; i-- {
+		if r.startsLine(list.Elems[i].Pos()) {
+			return r.lineIndent(list.Elems[i].Pos())
+		}
+	}
+	return r.lineIndent(list.Pos()) + r.IndentUnit()
+}
+
+// Range covering a node, its whole line when alone on it
+func (r *Rewriter) lineSpan(n Node) (int, int) {
+	src := r.file.Src
+	start, end := n.Pos(), n.End()
+	if lineEnd, blank := r.restOfLine(end); blank && r.startsLine(start) {
+		// Take the trailing comment and newline along
+		start = lineStart(src, start)
+		end = lineEnd
+		if end < len(src) {
+			end++
+		}
+		return start, end
+	}
+	// Drop the space after it, or before it at the end of a line
+	stop := end
+	for stop < len(src) && (src[stop] == ' ' || src[stop] == '\t') {
+		stop++
+	}
+	if stop > end {
+		return start, stop
+	}
+	for start > 0 && (src[start-1] == ' ' || src[start-1] == '\t') {
+		start--
+	}
+	return start, end
+}
+
+// End of the line holding pos, and whether the rest of it is blank or a comment
+func (r *Rewriter) restOfLine(pos int) (int, bool) {
+	src := r.file.Src
+	end := len(src)
+	if idx := strings.IndexByte(string(src[pos:]), '\n'); idx != -1 {
+		end = pos + idx
+	}
+	rest := strings.TrimSpace(string(src[pos:end]))
+	return end, rest == "" || strings.HasPrefix(rest, "#")
+}
+
+func (r *Rewriter) startsLine(pos int) bool {
+	src := r.file.Src
+	return strings.TrimSpace(string(src[lineStart(src, pos):pos])) == ""
+}
+
+func (r *Rewriter) sameLine(a, b int) bool {
+	return !strings.Contains(string(r.file.Src[a:b]), "\n")
+}
+
+func (r *Rewriter) lineIndent(pos int) string {
+	src := r.file.Src
+	line := string(src[lineStart(src, pos):pos])
+	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
+
+func lineStart(src []byte, pos int) int {
+	return strings.LastIndexByte(string(src[:pos]), '\n') + 1
+}
+
+func joinLines(indent string, items []string) string {
+	var b strings.Builder
+	for _, item := range items {
+		b.WriteString(indent + item + "\n")
+	}
+	return b.String()
+}
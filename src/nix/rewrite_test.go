@@ -0,0 +1,205 @@
+package nix
+
+import "testing"
+
+func TestAppendToList(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   string
+		items []string
+		want  string
+	}{
+		{
+			name:  "empty one-line",
+			src:   "{ a = [ ]; }",
+			items: []string{"pkgs.c"},
+			want:  "{ a = [ pkgs.c ]; }",
+		},
+		{
+			name:  "empty without spaces",
+			src:   "{ a = []; }",
+			items: []string{"pkgs.c"},
+			want:  "{ a = [ pkgs.c ]; }",
+		},
+		{
+			name:  "empty one-line with comment",
+			src:   "{ a = [ /* keep */ ]; }",
+			items: []string{"pkgs.c"},
+			want:  "{ a = [ /* keep */ pkgs.c ]; }",
+		},
+		{
+			name:  "one-line",
+			src:   "{ a = with pkgs; [ git htop ]; }",
+			items: []string{"vim", "jq"},
+			want:  "{ a = with pkgs; [ git htop vim jq ]; }",
+		},
+		{
+			name:  "multi-line",
+			src:   "{\n  a = [\n    pkgs.git # vcs\n    pkgs.htop\n  ];\n}\n",
+			items: []string{"pkgs.vim"},
+			want:  "{\n  a = [\n    pkgs.git # vcs\n    pkgs.htop\n    pkgs.vim\n  ];\n}\n",
+		},
+		{
+			name:  "multi-line with tabs",
+			src:   "{\n\ta = [\n\t\tpkgs.git\n\t];\n}\n",
+			items: []string{"pkgs.vim"},
+			want:  "{\n\ta = [\n\t\tpkgs.git\n\t\tpkgs.vim\n\t];\n}\n",
+		},
+		{
+			name:  "multi-line with trailing comment",
+			src:   "{\n  a = [\n    pkgs.git\n    # more later\n  ];\n}\n",
+			items: []string{"pkgs.vim"},
+			want:  "{\n  a = [\n    pkgs.git\n    # more later\n    pkgs.vim\n  ];\n}\n",
+		},
+		{
+			name:  "closing bracket after last element",
+			src:   "{\n  a = [\n    pkgs.git ];\n}\n",
+			items: []string{"pkgs.vim"},
+			want:  "{\n  a = [\n    pkgs.git\n    pkgs.vim ];\n}\n",
+		},
+		{
+			name:  "empty multi-line",
+			src:   "{\n  a = [\n\n  ];\n}\n",
+			items: []string{"pkgs.vim"},
+			want:  "{\n  a = [\n    pkgs.vim\n  ];\n}\n",
+		},
+		{
+			name:  "empty multi-line with comment",
+			src:   "{\n  a = [\n    # nothing yet\n  ];\n}\n",
+			items: []string{"pkgs.vim"},
+			want:  "{\n  a = [\n    # nothing yet\n    pkgs.vim\n  ];\n}\n",
+		},
+		{
+			name:  "quoted attr",
+			src:   "{ a = [ pkgs.git ]; }",
+			items: []string{`pkgs."3proxy"`},
+			want:  `{ a = [ pkgs.git pkgs."3proxy" ]; }`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := mustParse(t, tt.src)
+			rw := NewRewriter(f)
+			rw.AppendToList(FindLists(f, "a")[0].List, tt.items...)
+			got, err := rw.Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+			if _, err := Parse(got); err != nil {
+				t.Errorf("result does not parse: %v", err)
+			}
+		})
+	}
+}
+
+func TestRemoveListElem(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		remove string
+		want   string
+	}{
+		{
+			name:   "one-line middle",
+			src:    "{ a = [ git htop vim ]; }",
+			remove: "htop",
+			want:   "{ a = [ git vim ]; }",
+		},
+		{
+			name:   "one-line last",
+			src:    "{ a = [ git htop ]; }",
+			remove: "htop",
+			want:   "{ a = [ git ]; }",
+		},
+		{
+			name:   "one-line quoted attr",
+			src:    `{ a = [ pkgs."3proxy" pkgs.git ]; }`,
+			remove: `pkgs."3proxy"`,
+			want:   `{ a = [ pkgs.git ]; }`,
+		},
+		{
+			name:   "multi-line takes its line and comment",
+			src:    "{\n  a = [\n    git\n    htop # monitor\n    vim\n  ];\n}\n",
+			remove: "htop",
+			want:   "{\n  a = [\n    git\n    vim\n  ];\n}\n",
+		},
+		{
+			name:   "multi-line keeps comment lines",
+			src:    "{\n  a = [\n    # tools\n    git\n    htop\n  ];\n}\n",
+			remove: "git",
+			want:   "{\n  a = [\n    # tools\n    htop\n  ];\n}\n",
+		},
+		{
+			name:   "shared line",
+			src:    "{\n  a = [\n    git htop\n  ];\n}\n",
+			remove: "git",
+			want:   "{\n  a = [\n    htop\n  ];\n}\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := mustParse(t, tt.src)
+			rw := NewRewriter(f)
+			found := false
+			for _, e := range FindLists(f, "a")[0].List.Elems {
+				if f.Text(e) == tt.remove {
+					rw.RemoveListElem(e)
+					found = true
+				}
+			}
+			if !found {
+				t.Fatalf("%s not in the list", tt.remove)
+			}
+			got, err := rw.Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOverlappingEdits(t *testing.T) {
+	f := mustParse(t, "[ a b c ]")
+	rw := NewRewriter(f)
+	rw.Replace(2, 5, "x")
+	rw.Replace(4, 7, "y")
+	if _, err := rw.Bytes(); err == nil {
+		t.Fatal("expected an error for overlapping edits")
+	}
+
+	// Inserts next to a replacement are fine
+	rw = NewRewriter(f)
+	rw.Replace(2, 3, "x")
+	rw.Insert(3, " z")
+	rw.Insert(2, "w ")
+	got, err := rw.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "[ w x z b c ]" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestDetectIndentUnit(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"{\n  a = {\n    b = 1;\n  };\n}\n", "  "},
+		{"{\n    a = {\n        b = 1;\n    };\n}\n", "    "},
+		{"{\n\ta = {\n\t\tb = 1;\n\t};\n}\n", "\t"},
+		{"{ a = 1; }", "  "},
+	}
+	for _, tt := range tests {
+		if got := DetectIndentUnit([]byte(tt.src)); got != tt.want {
+			t.Errorf("DetectIndentUnit(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
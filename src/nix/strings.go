@@ -0,0 +1,159 @@
+package nix
+
+import "strings"
+
+// Decoded string value; false when the string has interpolations
+func (s *StringLit) Value() (string, bool) {
+	var b strings.Builder
+	for _, part := range s.Parts {
+		text, ok := part.(*StringText)
+		if !ok {
+			return "", false
+		}
+		if s.Indented {
+			b.WriteString(unescapeIndented(text.Raw))
+		} else {
+			b.WriteString(unescape(text.Raw))
+		}
+	}
+	if s.Indented {
+		return stripIndent(b.String()), true
+	}
+	return b.String(), true
+}
+
+func unescape(raw string) string {
+	var b strings.Builder
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		if c != '\\' || i+1 >= len(raw) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		switch raw[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		default:
+			b.WriteByte(raw[i])
+		}
+	}
+	return b.String()
+}
+
+func unescapeIndented(raw string) string {
+	var b strings.Builder
+	for i := 0; i < len(raw); i++ {
+		if strings.HasPrefix(raw[i:], "'''") {
+			b.WriteString("''")
+			i += 2
+			continue
+		}
+		if strings.HasPrefix(raw[i:], "''$") {
+			b.WriteByte('$')
+			i += 2
+			continue
+		}
+		if strings.HasPrefix(raw[i:], "''\\") && i+3 < len(raw) {
+			b.WriteString(unescape(raw[i+2 : i+4]))
+			i += 3
+			continue
+		}
+		b.WriteByte(raw[i])
+	}
+	return b.String()
+}
+
+// Remove the common leading indentation of an indented string
+func stripIndent(s string) string {
+	lines := strings.Split(s, "\n")
+	minIndent := -1
+	for _, l := range lines {
+		if strings.TrimSpace(l) == "" {
+			continue
+		}
+		indent := len(l) - len(strings.TrimLeft(l, " "))
+		if minIndent == -1 || indent < minIndent {
+			minIndent = indent
+		}
+	}
+	if minIndent <= 0 {
+		minIndent = 0
+	}
+	for i, l := range lines {
+		if len(l) >= minIndent {
+			lines[i] = l[minIndent:]
+		} else {
+			lines[i] = strings.TrimLeft(l, " ")
+		}
+	}
+	// A first line holding only whitespace is dropped
+	if len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Static name of an attribute path element
+func AttrName(n Node) (string, bool) {
+	switch n := n.(type) {
+	case *Identifier:
+		return n.Name, true
+	case *StringLit:
+		return n.Value()
+	}
+	return "", false
+}
+
+// Dotted name of an attribute path; dynamic parts become ${...}
+func AttrPathString(path []Node) string {
+	return strings.Join(AttrNames(path), ".")
+}
+
+// Names of an attribute path's parts; dynamic parts become ${...}
+func AttrNames(path []Node) []string {
+	names := make([]string, len(path))
+	for i, n := range path {
+		name, ok := AttrName(n)
+		if !ok {
+			name = "${...}"
+		}
+		names[i] = name
+	}
+	return names
+}
+
+// Whether a name can be written as a bare identifier
+func IsIdent(name string) bool {
+	if name == "" || !isIdentStart(name[0]) {
+		return false
+	}
+	for i := 1; i < len(name); i++ {
+		if !isIdentChar(name[i]) {
+			return false
+		}
+	}
+	_, keyword := keywords[name]
+	return !keyword
+}
+
+// Attribute name as written in source, quoted when it is not an identifier
+func QuoteAttr(name string) string {
+	if IsIdent(name) {
+		return name
+	}
+	return `"` + Escape(name) + `"`
+}
+
+// Dotted attribute path, each name quoted as needed
+func FormatAttrPath(names ...string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = QuoteAttr(name)
+	}
+	return strings.Join(quoted, ".")
+}
@@ -0,0 +1,153 @@
+package nix
+
+import "fmt"
+
+type TokenKind int
+
+const (
+	TokEOF TokenKind = iota
+	TokIdent
+	TokInt
+	TokFloat
+	TokPath
+	TokSearchPath
+	TokURI
+	TokString
+	TokIndString
+
+	// Keywords
+	TokLet
+	TokIn
+	TokRec
+	TokWith
+	TokInherit
+	TokIf
+	TokThen
+	TokElse
+	TokAssert
+	TokOr
+
+	// Punctuation
+	TokLBrace
+	TokRBrace
+	TokLBracket
+	TokRBracket
+	TokLParen
+	TokRParen
+	TokDollarCurly
+	TokSemicolon
+	TokColon
+	TokComma
+	TokDot
+	TokEllipsis
+	TokAt
+	TokAssign
+	TokQuestion
+
+	// Operators
+	TokConcat
+	TokPlus
+	TokMinus
+	TokStar
+	TokSlash
+	TokUpdate
+	TokEq
+	TokNotEq
+	TokLess
+	TokLessEq
+	TokGreater
+	TokGreaterEq
+	TokAnd
+	TokOrOp
+	TokImplies
+	TokNot
+)
+
+var keywords = map[string]TokenKind{
+	"let":     TokLet,
+	"in":      TokIn,
+	"rec":     TokRec,
+	"with":    TokWith,
+	"inherit": TokInherit,
+	"if":      TokIf,
+	"then":    TokThen,
+	"else":    TokElse,
+	"assert":  TokAssert,
+	"or":      TokOr,
+}
+
+var tokenNames = map[TokenKind]string{
+	TokEOF:         "end of file",
+	TokIdent:       "identifier",
+	TokInt:         "integer",
+	TokFloat:       "float",
+	TokPath:        "path",
+	TokSearchPath:  "search path",
+	TokURI:         "URI",
+	TokString:      "string",
+	TokIndString:   "indented string",
+	TokLet:         "'let'",
+	TokIn:          "'in'",
+	TokRec:         "'rec'",
+	TokWith:        "'with'",
+	TokInherit:     "'inherit'",
+	TokIf:          "'if'",
+	TokThen:        "'then'",
+	TokElse:        "'else'",
+	TokAssert:      "'assert'",
+	TokOr:          "'or'",
+	TokLBrace:      "'{'",
+	TokRBrace:      "'}'",
+	TokLBracket:    "'['",
+	TokRBracket:    "']'",
+	TokLParen:      "'('",
+	TokRParen:      "')'",
+	TokDollarCurly: "'${'",
+	TokSemicolon:   "';'",
+	TokColon:       "':'",
+	TokComma:       "','",
+	TokDot:         "'.'",
+	TokEllipsis:    "'...'",
+	TokAt:          "'@'",
+	TokAssign:      "'='",
+	TokQuestion:    "'?'",
+	TokConcat:      "'++'",
+	TokPlus:        "'+'",
+	TokMinus:       "'-'",
+	TokStar:        "'*'",
+	TokSlash:       "'/'",
+	TokUpdate:      "'//'",
+	TokEq:          "'=='",
+	TokNotEq:       "'!='",
+	TokLess:        "'<'",
+	TokLessEq:      "'<='",
+	TokGreater:     "'>'",
+	TokGreaterEq:   "'>='",
+	TokAnd:         "'&&'",
+	TokOrOp:        "'||'",
+	TokImplies:     "'->'",
+	TokNot:         "'!'",
+}
+
+func (k TokenKind) String() string {
+	if name, ok := tokenNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("token(%d)", int(k))
+}
+
+// Span of an interpolation inside a string or path token
+type Span struct {
+	Start int
+	End   int
+}
+
+type Token struct {
+	Kind TokenKind
+	Pos  int
+	End  int
+	Text string
+
+	// Interpolations (${ ... }) inside strings and paths, excluding the delimiters
+	Interps []Span
+}
@@ -0,0 +1,84 @@
+package nix
+
+// Direct children of a node, in source order
+func Children(n Node) []Node {
+	var out []Node
+	add := func(nodes ...Node) {
+		for _, c := range nodes {
+			if c != nil {
+				out = append(out, c)
+			}
+		}
+	}
+	switch n := n.(type) {
+	case *StringLit:
+		add(n.Parts...)
+	case *InterpPath:
+		add(n.Parts...)
+	case *Interpolation:
+		add(n.Expr)
+	case *List:
+		add(n.Elems...)
+	case *AttrSet:
+		for _, b := range n.Bindings {
+			add(b)
+		}
+	case *Let:
+		for _, b := range n.Bindings {
+			add(b)
+		}
+		add(n.Body)
+	case *With:
+		add(n.Env, n.Body)
+	case *Assert:
+		add(n.Cond, n.Body)
+	case *If:
+		add(n.Cond, n.Then, n.Else)
+	case *Lambda:
+		if n.Arg != nil {
+			add(n.Arg)
+		}
+		if n.Formals != nil {
+			add(n.Formals)
+		}
+		add(n.Body)
+	case *Formals:
+		for _, f := range n.Params {
+			add(f)
+		}
+	case *Formal:
+		add(n.Name, n.Default)
+	case *Apply:
+		add(n.Func, n.Arg)
+	case *Select:
+		add(n.Expr)
+		add(n.Path...)
+		add(n.Default)
+	case *HasAttr:
+		add(n.Expr)
+		add(n.Path...)
+	case *BinaryOp:
+		add(n.Left, n.Right)
+	case *UnaryOp:
+		add(n.Expr)
+	case *Paren:
+		add(n.Expr)
+	case *Attr:
+		add(n.Path...)
+		add(n.Value)
+	case *Inherit:
+		add(n.From)
+		add(n.Names...)
+	}
+	return out
+}
+
+// Depth-first walk; returning false skips the node's children
+func Inspect(n Node, fn func(Node) bool) {
+	if n == nil || !fn(n) {
+		return
+	}
+	for _, c := range Children(n) {
+		Inspect(c, fn)
+	}
+}
@@ -1,212 +1,299 @@
 package main
 
 import (
-	"context"
+	cache "alloylinux/apm/src/database"
+	"alloylinux/apm/src/nix"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
 	"time"
-
-	"github.com/glebarez/sqlite"
-	"gorm.io/gorm"
 )
 
 // Check if input exists in flake
 func inputExistsInFlake(flakePath, inputName string) bool {
-	content, err := os.ReadFile(flakePath)
+	flake, err := parseNixFile(flakePath)
 	if err != nil {
 		return false
 	}
-	return strings.Contains(string(content), inputName+".url")
+	inputs, _, _ := flakeInputs(flake)
+	in := findInput(inputs, inputName)
+	return in != nil && in.URL != ""
 }
 
-// Ensure unstable input exists
-func ensureUnstableInput(flakeLocation string) error {
-	flakePath := filepath.Join(flakeLocation, "flake.nix")
+// Step adding the unstable input, nil when the flake has it
+func unstableInputStep(flakeLocation string) (*scaffoldStep, error) {
+	return inputStep(filepath.Join(flakeLocation, "flake.nix"), unstableChannel, unstableURL)
+}
 
-	// Check if unstable input already exists
-	if inputExistsInFlake(flakePath, "unstable") {
-		return nil
+// Resolve names to installable packages, collecting failures
+func resolvePackages(queries []string, method InstallationMethod, exact bool, channel string) ([]string, []string) {
+	var resolved, failures []string
+	seen := map[string]bool{}
+	for _, query := range queries {
+		pkgName, err := resolvePackage(query, method, exact, channel)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", query, err))
+			continue
+		}
+		if !seen[pkgName] {
+			seen[pkgName] = true
+			resolved = append(resolved, pkgName)
+		}
 	}
+	return resolved, failures
+}
 
-	// Ask user if they want to add the unstable input
-	fmt.Println("Unstable packages require the 'unstable' nixpkgs input.")
-	fmt.Print("Add unstable input (github:NixOS/nixpkgs/nixos-unstable)? [y/N]: ")
-	var response string
-	fmt.Scanln(&response)
-	if strings.ToLower(strings.TrimSpace(response)) != "y" {
-		fmt.Println("Unstable input not added. Package installation may fail.")
-		return nil
+// Resolve one name against a channel's cache, searching unless exact
+func resolvePackage(query string, method InstallationMethod, exact bool, channel string) (string, error) {
+	if exact {
+		// Check Flathub availability
+		if method == Flatpak {
+			available, resolvedAppID := isFlatpakAvailable(query)
+			if !available {
+				return "", fmt.Errorf("flatpak not found")
+			}
+			// Use resolved app ID
+			return resolvedAppID, nil
+		}
+		if !doesPackageExist(query, channel) {
+			return "", fmt.Errorf("package not found in %s", channel)
+		}
+		return query, nil
+	}
+
+	// Search for packages
+	candidates, err := SearchPackages(query, method, channel)
+	if err != nil {
+		return "", fmt.Errorf("error searching packages: %v", err)
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no matching packages found (try --exact or run makecache)")
+	}
+	if len(candidates) == 1 {
+		return candidates[0].Attr(), nil
+	}
+	for _, p := range candidates {
+		if p.Attr() == query {
+			return p.Attr(), nil
+		}
 	}
 
-	// Add the unstable input
-	return addInput(flakePath, "unstable", "github:NixOS/nixpkgs/nixos-unstable")
+	// Show numbered list
+	options := make([]string, len(candidates))
+	for i, p := range candidates {
+		options[i] = fmt.Sprintf("%s - %s", p.Attr(), p.Description)
+	}
+	choice, err := prompter.Choose(fmt.Sprintf("Multiple matches found for '%s'; choose one:", query), options)
+	if errors.Is(err, errNoChoice) {
+		attrs := make([]string, len(candidates))
+		for i, p := range candidates {
+			attrs[i] = p.Attr()
+		}
+		return "", fmt.Errorf("matches %d packages (%s); pass the exact attribute path of one", len(candidates), strings.Join(attrs, ", "))
+	}
+	if err != nil {
+		return "", err
+	}
+	return candidates[choice].Attr(), nil
 }
 
-// Install package
-func installPackage(pkgName, flakeLocation string, method InstallationMethod, unstable bool) {
-	// Skip Nixpkgs check for Flatpak
-	if method != Flatpak && !doesPackageExist(pkgName) {
-		fmt.Println("Package not found in Nixpkgs.")
-		return
+// Install packages
+func installPackages(pkgNames []string, flakeLocation string, method InstallationMethod, unstable bool, file string) error {
+	// Check if already installed
+	var pending []string
+	for _, pkgName := range pkgNames {
+		if presentInFlake(pkgName, flakeLocation, method) {
+			fmt.Printf("%s already installed.\n", pkgName)
+			continue
+		}
+		pending = append(pending, pkgName)
+	}
+	if len(pending) == 0 {
+		return nil
 	}
 
-	// Check Flathub availability
-	if method == Flatpak {
-		available, resolvedAppID := isFlatpakAvailable(pkgName)
-		if !available {
-			fmt.Printf("Flatpak '%s' not found.\n", pkgName)
-			return
+	// Pick the one file to edit before asking anything else
+	block := blockNameForMethod(method)
+	target, err := targetPackageFile(flakeLocation, method, file)
+	if err != nil {
+		return err
+	}
+
+	// Everything the flake needs first goes into the same plan
+	steps, err := scaffoldSteps(flakeLocation, method, unstable, target)
+	if err != nil {
+		return err
+	}
+	if target == "" {
+		target = filepath.Join(flakeLocation, "packages", packageFileNames[method])
+	}
+
+	// Ask once before modifying files
+	var warnings map[string][]string
+	if method != Flatpak {
+		warnings = packageWarnings(pending, installChannel(unstable))
+	}
+	entries := make([]string, len(pending))
+	into := relToFlake(flakeLocation, target)
+	if len(steps) > 0 {
+		fmt.Println("About to:")
+		for _, step := range steps {
+			fmt.Printf("  * %s\n", step.Description)
+		}
+		fmt.Printf("and install (%s) into %s:\n", methodDisplayName(method), into)
+	} else {
+		fmt.Printf("About to install (%s) into %s:\n", methodDisplayName(method), into)
+	}
+	for i, pkgName := range pending {
+		entries[i] = buildEntry(pkgName, method, unstable)
+		fmt.Printf("  + %s\n", entries[i])
+		for _, w := range warnings[pkgName] {
+			fmt.Printf("      Warning: %s is %s\n", pkgName, w)
 		}
-		// Use resolved app ID
-		pkgName = resolvedAppID
+	}
+	ok, err := prompter.Confirm("Proceed?", false)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fmt.Println("Installation cancelled.")
+		return nil
 	}
 
-	// Check if already installed
-	if presentInFlake(pkgName, flakeLocation, method) {
-		fmt.Printf("%s already installed.\n", pkgName)
-		return
+	for _, step := range steps {
+		if err := step.Run(); err != nil {
+			return err
+		}
 	}
 
-	// Ensure unstable input exists if using unstable packages
+	added, res, err := insertIntoNixBlock(target, block, entries, method)
+	if err != nil {
+		return err
+	}
+	switch res {
+	case InsertAdded:
+		for _, entry := range added {
+			fmt.Printf("Added %s to %s\n", entry, target)
+		}
+	case InsertAlreadyPresent:
+		fmt.Printf("%s already in %s\n", strings.Join(pending, ", "), target)
+	case InsertError:
+		if _, err := parseNixFile(target); err != nil {
+			return fmt.Errorf("could not parse %s: %v", target, err)
+		}
+		return fmt.Errorf("%s has no '%s' list", target, block)
+	}
+	return nil
+}
+
+// Inputs, modules and the package file the flake lacks before packages
+// can go into target, which is empty when no file has the list yet
+func scaffoldSteps(flakeLocation string, method InstallationMethod, unstable bool, target string) ([]scaffoldStep, error) {
+	var steps []scaffoldStep
 	if unstable && method != Flatpak {
-		err := ensureUnstableInput(flakeLocation)
+		step, err := unstableInputStep(flakeLocation)
 		if err != nil {
-			fmt.Printf("Error setting up unstable input: %v\n", err)
-			return
+			return nil, fmt.Errorf("error setting up unstable input: %v", err)
 		}
+		if step != nil {
+			steps = append(steps, *step)
+		}
+	}
+	if target != "" {
+		return steps, nil
 	}
 
-	// Ask for confirmation before modifying files
-	var methodName string
+	var files []scaffoldStep
+	var err error
 	switch method {
+	case HomeManager:
+		files, err = homeEnvSteps(flakeLocation)
 	case NixEnv:
-		methodName = "NixEnv"
+		files, err = nixEnvSteps(flakeLocation)
 	case Flatpak:
-		methodName = "Flatpak"
-	case HomeManager:
-		methodName = "HomeManager"
-	default:
-		methodName = "Unknown"
-	}
-	fmt.Printf("About to install '%s' (%s)\n", pkgName, methodName)
-	fmt.Print("Proceed? [y/N]: ")
-	var response string
-	fmt.Scanln(&response)
-	if strings.ToLower(strings.TrimSpace(response)) != "y" {
-		fmt.Println("Installation cancelled.")
-		return
+		files, err = flatpakSteps(flakeLocation)
 	}
-
-	// Get all .nix files
-	files, err := ListFilePaths(flakeLocation)
 	if err != nil {
-		fmt.Printf("Error reading files: %v\n", err)
-		return
+		return nil, fmt.Errorf("error creating packages file: %v", err)
 	}
+	return append(steps, files...), nil
+}
 
-	// Check if any file contains the required block
+// File new packages go into: --file, then files.<method> from the config,
+// then the only file with the method's list, or the one the user picks.
+// Empty when no file has the list yet.
+func targetPackageFile(flakeLocation string, method InstallationMethod, file string) (string, error) {
 	block := blockNameForMethod(method)
-	hasBlock := false
-	for _, f := range files {
-		if !strings.HasSuffix(f, ".nix") {
-			continue
+	if file != "" {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(flakeLocation, file)
 		}
-		content, err := os.ReadFile(f)
-		if err != nil {
-			continue
+		if !fileHasBlock(file, block) {
+			return "", fmt.Errorf("%s has no '%s' list", file, block)
 		}
-		if strings.Contains(string(content), block) {
-			hasBlock = true
-			break
+		return file, nil
+	}
+	if file := configuredPackageFile(flakeLocation, method); file != "" {
+		if !fileHasBlock(file, block) {
+			return "", fmt.Errorf("%s has no '%s' list (set as files.%s in the config)", file, block, methodFlagName(method))
 		}
+		return file, nil
 	}
 
-	// If no file has the required block, create the appropriate package file
-	if !hasBlock {
-		switch method {
-		case HomeManager:
-			fmt.Println("No home-manager packages file found. Creating one...")
-			makeHomeEnv()
-			// Re-get the file list after creating the file
-			files, err = ListFilePaths(flakeLocation)
-			if err != nil {
-				fmt.Printf("Error reading files: %v\n", err)
-				return
-			}
-		case NixEnv:
-			fmt.Println("No Nix environment packages file found. Creating one...")
-			makeNixEnv()
-			// Re-get the file list after creating the file
-			files, err = ListFilePaths(flakeLocation)
-			if err != nil {
-				fmt.Printf("Error reading files: %v\n", err)
-				return
-			}
-		case Flatpak:
-			fmt.Println("No Flatpak packages file found. Creating one...")
-			setupFlatpak()
-			// For Flatpak, we need to create the packages file manually since setupFlatpak doesn't do it
-			homedir, err := os.UserHomeDir()
-			if err != nil {
-				fmt.Printf("Error getting home directory: %v\n", err)
-				return
-			}
-			flakeLocationPath := filepath.Join(homedir, ".config", "apm", "flakelocation.txt")
-			flakeDir, err := readFlakeLocation(flakeLocationPath)
-			if err != nil {
-				fmt.Printf("Error reading flake location: %v\n", err)
-				return
-			}
-			createPackageFile(flakeDir, "flatpak-packages.nix", "services.flatpak.packages", flatpakPackagesBoilerplate, "./packages/flatpak-packages.nix")
-			// Re-get the file list after creating the file
-			files, err = ListFilePaths(flakeLocation)
-			if err != nil {
-				fmt.Printf("Error reading files: %v\n", err)
-				return
-			}
-		}
+	candidates, err := blockFiles(flakeLocation, block)
+	if err != nil {
+		return "", fmt.Errorf("error reading files: %v", err)
+	}
+	switch len(candidates) {
+	case 0:
+		return "", nil
+	case 1:
+		return candidates[0], nil
+	}
+	options := make([]string, len(candidates))
+	for i, c := range candidates {
+		options[i] = relToFlake(flakeLocation, c)
+	}
+	question := fmt.Sprintf("Several files have a '%s' list; which one should get the packages? (use --file or 'apm config set files.%s' to skip this)", block, methodFlagName(method))
+	choice, err := prompter.Choose(question, options)
+	if errors.Is(err, errNoChoice) {
+		return "", fmt.Errorf("several files have a '%s' list (%s); pick one with --file or 'apm config set files.%s'", block, strings.Join(options, ", "), methodFlagName(method))
+	}
+	if err != nil {
+		return "", err
 	}
+	return candidates[choice], nil
+}
 
-	modified := false
-	filesProcessed := 0
-	// Process each .nix file
+// Files with the block, in path order
+func blockFiles(flakeLocation, block string) ([]string, error) {
+	files, err := packageFiles(flakeLocation)
+	if err != nil {
+		return nil, err
+	}
+	var found []string
 	for _, f := range files {
-		if !strings.HasSuffix(f, ".nix") {
-			continue
-		}
-
-		entry := buildEntry(pkgName, method, unstable)
-
-		res := insertIntoNixBlock(f, block, entry, method)
-		filesProcessed++
-		switch res {
-		case InsertAdded:
-			fmt.Printf("Added %s to %s\n", pkgName, f)
-			modified = true
-		case InsertAlreadyPresent:
-			fmt.Printf("%s already in %s\n", pkgName, f)
-		case InsertError:
-			// Only show real file errors
-			if _, err := os.ReadFile(f); err != nil {
-				fmt.Printf("File error: %s\n", f)
-			}
-			// Skip files without block
+		if fileHasBlock(f, block) {
+			found = append(found, f)
 		}
 	}
+	sort.Strings(found)
+	return found, nil
+}
 
-	// Show result summary
-	if !modified {
-		if filesProcessed == 0 {
-			fmt.Println("No .nix files found.")
-		} else {
-			fmt.Printf("No file with '%s' block found.\n", block)
-		}
+// Path relative to the flake for messages
+func relToFlake(flakeLocation, path string) string {
+	if rel, err := filepath.Rel(flakeLocation, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
 	}
+	return path
 }
 
 // Build entry
@@ -220,17 +307,22 @@ func buildEntry(pkgName string, method InstallationMethod, unstable bool) string
 			if strings.HasPrefix(pkgName, "unstable.") {
 				return pkgName
 			}
-			return "unstable." + pkgName
+			return "unstable." + attrPathExpr(pkgName)
 		}
 		if strings.HasPrefix(pkgName, "pkgs.") || strings.HasPrefix(pkgName, "unstable.") {
 			return pkgName
 		}
-		return "pkgs." + pkgName
+		return "pkgs." + attrPathExpr(pkgName)
 	default:
 		return pkgName
 	}
 }
 
+// Attribute path as Nix source, quoting names like "3proxy"
+func attrPathExpr(attrPath string) string {
+	return nix.FormatAttrPath(strings.Split(attrPath, ".")...)
+}
+
 // Block name
 func blockNameForMethod(method InstallationMethod) string {
 	// Map method to config block
@@ -253,15 +345,8 @@ func presentInFlake(pkgName, flakeLocation string, method InstallationMethod) bo
 		return false
 	}
 	for _, e := range installed {
-		t := strings.TrimSpace(e)
-		if method == Flatpak {
-			if strings.Contains(t, pkgName) || strings.Contains(t, fmt.Sprintf("appId = \"%s\"", pkgName)) {
-				return true
-			}
-		} else {
-			if t == pkgName || t == "pkgs."+pkgName || t == "unstable."+pkgName {
-				return true
-			}
+		if entryMatches(e, pkgName, method) {
+			return true
 		}
 	}
 	return false
@@ -275,124 +360,135 @@ const (
 	InsertAlreadyPresent
 )
 
-func insertIntoNixBlock(file, blockName, entry string, method InstallationMethod) InsertStatus {
-	data, err := os.ReadFile(file)
+// Insert entries into the block, returning the ones actually added.
+// The error is only set when writing the file failed.
+func insertIntoNixBlock(file, blockName string, entries []string, method InstallationMethod) ([]string, InsertStatus, error) {
+	parsed, err := parseNixFile(file)
 	if err != nil {
-		return InsertError
+		return nil, InsertError, nil
+	}
+	matches := packageLists(file, parsed, blockName)
+	if len(matches) == 0 {
+		// Block not found
+		return nil, InsertError, nil
 	}
-	lines := strings.Split(string(data), "\n")
 
-	// Find block name line
-	blockLineIdx := -1
-	for i, l := range lines {
-		if strings.Contains(l, blockName) {
-			blockLineIdx = i
+	// Prefer the unconditional list
+	target := matches[0]
+	for _, m := range matches {
+		if !m.Conditional {
+			target = m
 			break
 		}
 	}
-	if blockLineIdx == -1 {
-		// Block not found
-		return InsertError
-	}
 
-	// Find opening bracket
-	openIdx := -1
-	for i := blockLineIdx; i < len(lines); i++ {
-		if strings.Contains(lines[i], "[") {
-			openIdx = i
-			break
+	var added, items []string
+	for _, entry := range entries {
+		// Check if already exists
+		if entryInLists(parsed, matches, entry, method) {
+			continue
+		}
+		added = append(added, entry)
+		// Bare inside `with pkgs;`
+		if method != Flatpak {
+			entry = entryForList(entry, listScope(target))
 		}
+		items = append(items, entry)
 	}
-	if openIdx == -1 {
-		return InsertError
+	if len(items) == 0 {
+		return nil, InsertAlreadyPresent, nil
 	}
 
-	// Find closing bracket
-	closeIdx := -1
-	for i := openIdx; i < len(lines); i++ {
-		if strings.Contains(lines[i], "]") {
-			closeIdx = i
-			break
-		}
+	// Add entries before closing bracket
+	rw := nix.NewRewriter(parsed)
+	rw.AppendToList(target.List, items...)
+
+	out, err := rw.Bytes()
+	if err != nil {
+		return nil, InsertError, fmt.Errorf("error editing %s: %v", file, err)
 	}
-	if closeIdx == -1 {
-		return InsertError
+	err = changes.WriteFile(file, out)
+	if err != nil {
+		return nil, InsertError, fmt.Errorf("error writing %s: %v", file, err)
 	}
+	return added, InsertAdded, nil
+}
 
-	// Check if already exists
-	alreadyPresent := false
-	for i := openIdx + 1; i < closeIdx; i++ {
-		l := lines[i]
-		switch method {
-		case Flatpak:
-			if strings.Contains(l, entry) || (strings.Contains(l, "appId") && strings.Contains(l, strings.Split(entry, `"`)[1])) {
-				alreadyPresent = true
-			}
-		default:
-			if strings.TrimSpace(l) == entry {
-				alreadyPresent = true
-			}
+// Check if any of the lists holds the entry
+func entryInLists(parsed *nix.File, matches []nix.ListMatch, entry string, method InstallationMethod) bool {
+	name := entry
+	if method == Flatpak {
+		if m := appIdPattern.FindStringSubmatch(entry); m != nil {
+			name = m[1]
 		}
-		if alreadyPresent {
-			break
+	}
+	for _, m := range matches {
+		scope := listScope(m)
+		for _, elem := range m.List.Elems {
+			text := normalizeEntry(strings.Join(strings.Fields(parsed.Text(elem)), " "), scope)
+			if entryMatches(text, name, method) {
+				return true
+			}
 		}
 	}
+	return false
+}
 
-	if alreadyPresent {
-		return InsertAlreadyPresent
+// Unfree, broken, insecure or unsupported packages among pkgNames,
+// with the reasons; the cache only knows this when built with meta
+func packageWarnings(pkgNames []string, channel string) map[string][]string {
+	db, err := cache.Open(channel)
+	if err != nil {
+		return nil
 	}
+	defer db.Close()
 
-	// Add entry before closing bracket
-	newLines := make([]string, 0, len(lines)+1)
-	newLines = append(newLines, lines[:closeIdx]...)
-	newLines = append(newLines, "    "+entry)
-	newLines = append(newLines, lines[closeIdx:]...)
-
-	err = os.WriteFile(file, []byte(strings.Join(newLines, "\n")), 0644)
-	if err != nil {
-		return InsertError
+	system := hostSystem()
+	warnings := map[string][]string{}
+	for _, name := range pkgNames {
+		pkg, err := db.Package(name)
+		if err != nil || pkg == nil {
+			continue
+		}
+		if w := pkg.Warnings(system); len(w) > 0 {
+			warnings[name] = w
+		}
 	}
-	return InsertAdded
+	return warnings
 }
 
-type PackageInfo struct {
-	Description string
-	Pname       string
-	Version     string
+// Nix system string of this machine, e.g. x86_64-linux
+func hostSystem() string {
+	arch := runtime.GOARCH
+	switch arch {
+	case "amd64":
+		arch = "x86_64"
+	case "arm64":
+		arch = "aarch64"
+	case "386":
+		arch = "i686"
+	}
+	return arch + "-" + runtime.GOOS
 }
 
-func doesPackageExist(pkgName string) bool {
-	homedir, err := os.UserHomeDir()
-	if err != nil {
-		fmt.Printf("X Home directory error: %v\n", err)
+func doesPackageExist(pkgName, channel string) bool {
+	db, err := cache.Open(channel)
+	if errors.Is(err, cache.ErrNoCache) || errors.Is(err, cache.ErrOutdated) {
+		fmt.Printf("%v\n", err)
 		return false
 	}
-	apmDir := homedir + "/.cache/apm"
-	dbPath := apmDir + "/apm.db"
-
-	// Check if database file exists
-	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
-		fmt.Println("No local database found! Generate it with 'apm makecache'")
-		return false
-	}
-
-	ctx := context.Background()
-	db, err := gorm.Open(sqlite.Open(dbPath), &gorm.Config{})
 	if err != nil {
 		fmt.Printf("X Database error: %v\n", err)
 		return false
 	}
+	defer db.Close()
 
-	var pkg PackageInfo
-	result := db.WithContext(ctx).Where("pname = ?", pkgName).First(&pkg)
-
-	// Check for table not found error
-	if result.Error != nil && strings.Contains(result.Error.Error(), "no such table") {
-		fmt.Println("No local database found! Generate it with 'apm makecache'")
+	pkg, err := db.Package(pkgName)
+	if err != nil {
+		fmt.Printf("X Database error: %v\n", err)
 		return false
 	}
-
-	return result.Error == nil
+	return pkg != nil
 }
 
 func ListFilePaths(dir string) ([]string, error) {
@@ -412,10 +508,11 @@ func ListFilePaths(dir string) ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
-	return paths, nil
+	// Files a dry run would have created
+	return append(paths, changes.Created(dir, ".nix")...), nil
 }
 
-func searchFlathub(query string) ([]PackageInfo, error) {
+func searchFlathub(query string) ([]cache.PackageInfo, error) {
 	encodedQuery := url.QueryEscape(query)
 	url := fmt.Sprintf("https://flathub.org/api/v1/apps/search/%s", encodedQuery)
 	resp, err := http.Get(url)
@@ -466,10 +563,10 @@ func searchFlathub(query string) ([]PackageInfo, error) {
 		}
 	}
 
-	var results []PackageInfo
+	var results []cache.PackageInfo
 	// Add exact matches first
 	for _, app := range exactMatches {
-		results = append(results, PackageInfo{
+		results = append(results, cache.PackageInfo{
 			Pname:       app.FlatpakAppId,
 			Description: app.Summary,
 			Version:     "",
@@ -477,7 +574,7 @@ func searchFlathub(query string) ([]PackageInfo, error) {
 	}
 	// Then starts with matches
 	for _, app := range startsWithMatches {
-		results = append(results, PackageInfo{
+		results = append(results, cache.PackageInfo{
 			Pname:       app.FlatpakAppId,
 			Description: app.Summary,
 			Version:     "",
@@ -485,7 +582,7 @@ func searchFlathub(query string) ([]PackageInfo, error) {
 	}
 	// Then contains matches
 	for _, app := range containsMatches {
-		results = append(results, PackageInfo{
+		results = append(results, cache.PackageInfo{
 			Pname:       app.FlatpakAppId,
 			Description: app.Summary,
 			Version:     "",
@@ -500,65 +597,17 @@ func searchFlathub(query string) ([]PackageInfo, error) {
 	return results, nil
 }
 
-func SearchPackages(query string, method InstallationMethod) ([]PackageInfo, error) {
+func SearchPackages(query string, method InstallationMethod, channel string) ([]cache.PackageInfo, error) {
 	if method == Flatpak {
 		return searchFlathub(query)
 	}
-	homedir, err := os.UserHomeDir()
-	if err != nil {
-		return nil, err
-	}
-	dbPath := homedir + "/.cache/apm/apm.db"
-
-	// Check if database file exists
-	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
-		return nil, fmt.Errorf("no local database found! Generate it with 'apm makecache'")
-	}
-
-	ctx := context.Background()
-	db, err := gorm.Open(sqlite.Open(dbPath), &gorm.Config{})
+	db, err := cache.Open(channel)
 	if err != nil {
 		return nil, err
 	}
+	defer db.Close()
 
-	var results []PackageInfo
-	var exactMatches []PackageInfo
-	var startsWithMatches []PackageInfo
-	var containsMatches []PackageInfo
-
-	// First, find exact matches
-	err = db.WithContext(ctx).Where("pname = ?", query).Find(&exactMatches).Error
-	if err != nil {
-		// Check for table not found error
-		if strings.Contains(err.Error(), "no such table") {
-			return nil, fmt.Errorf("no local database found! Generate it with 'apm makecache'")
-		}
-		return nil, err
-	}
-
-	// Then, find packages that start with the query
-	err = db.WithContext(ctx).Where("pname LIKE ?", query+"%").Find(&startsWithMatches).Error
-	if err != nil {
-		return nil, err
-	}
-
-	// Finally, find packages that contain the query (but don't start with it)
-	err = db.WithContext(ctx).Where("pname LIKE ? AND pname NOT LIKE ?", "%"+query+"%", query+"%").Find(&containsMatches).Error
-	if err != nil {
-		return nil, err
-	}
-
-	// Combine results in order of relevance, limiting to 10 total
-	results = append(results, exactMatches...)
-	results = append(results, startsWithMatches...)
-	results = append(results, containsMatches...)
-
-	// Limit to 10 results
-	if len(results) > 10 {
-		results = results[:10]
-	}
-
-	return results, nil
+	return db.FindByName(query, 10)
 }
 
 func isFlatpakAvailable(appID string) (bool, string) {
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Name of the unnamed profile, the top-level flake setting
+const defaultProfile = "default"
+
+// Flake managed under a name, e.g. laptop or homelab
+type Profile struct {
+	Flake string `json:"flake"`
+}
+
+// Profile of this run, empty for the top-level settings, and where the
+// name came from
+var activeProfile, profileSource string
+
+// Pick the profile from --profile, then APM_PROFILE, then the config file.
+// An unknown name only fails once the flake is needed, so the profile
+// commands can still create it.
+func selectProfile(flag string) {
+	name, from := flag, "--profile"
+	if name == "" {
+		name, from = os.Getenv("APM_PROFILE"), "APM_PROFILE"
+	}
+	if name == "" {
+		name, from = settings.Profile, "the config file"
+	}
+	if name == defaultProfile {
+		name = ""
+	}
+	activeProfile, profileSource = name, from
+}
+
+// Error when the active profile isn't in the config file
+func checkProfile() error {
+	if activeProfile == "" {
+		return nil
+	}
+	if _, ok := settings.Profiles[activeProfile]; !ok {
+		return fmt.Errorf("unknown profile '%s' (from %s); add it with 'apm profile add %s <flake>'", activeProfile, profileSource, activeProfile)
+	}
+	return nil
+}
+
+// Flake directory of the active profile, empty when it is unknown
+func profileFlake() string {
+	if activeProfile == "" {
+		return settings.Flake
+	}
+	return settings.Profiles[activeProfile].Flake
+}
+
+// Point the active profile at another flake
+func setProfileFlake(dir string) error {
+	if activeProfile == "" {
+		return setConfigValue("flake", dir)
+	}
+	if err := checkProfile(); err != nil {
+		return err
+	}
+	if dir == "" {
+		return errors.New("the flake location can't be empty")
+	}
+	p := settings.Profiles[activeProfile]
+	p.Flake = dir
+	settings.Profiles[activeProfile] = p
+	return settings.save()
+}
+
+func validProfileName(name string) error {
+	if name == "" || name == defaultProfile || strings.ContainsAny(name, " \t/") {
+		return fmt.Errorf("invalid profile name '%s'", name)
+	}
+	return nil
+}
+
+// Add a profile, or point an existing one at another flake
+func addProfile(name, flake string) error {
+	if err := validProfileName(name); err != nil {
+		return err
+	}
+	if flake == "" {
+		return errors.New("the flake location can't be empty")
+	}
+	if settings.Profiles == nil {
+		settings.Profiles = map[string]Profile{}
+	}
+	p := settings.Profiles[name]
+	p.Flake = flake
+	settings.Profiles[name] = p
+	return settings.save()
+}
+
+func removeProfile(name string) error {
+	if _, ok := settings.Profiles[name]; !ok {
+		return fmt.Errorf("no profile named '%s'", name)
+	}
+	delete(settings.Profiles, name)
+	if settings.Profile == name {
+		settings.Profile = ""
+	}
+	return settings.save()
+}
+
+// Make a profile the one used without --profile or APM_PROFILE
+func useProfile(name string) error {
+	return setConfigValue("profile", name)
+}
+
+// Print every profile, marking the active one
+func listProfiles() {
+	names := []string{defaultProfile}
+	var named []string
+	for name := range settings.Profiles {
+		named = append(named, name)
+	}
+	sort.Strings(named)
+	names = append(names, named...)
+
+	for _, name := range names {
+		flake := settings.Flake
+		if name != defaultProfile {
+			flake = settings.Profiles[name].Flake
+		}
+		marker := " "
+		if name == activeProfile || (name == defaultProfile && activeProfile == "") {
+			marker = "*"
+		}
+		fmt.Printf("%s %-12s %s\n", marker, name, flake)
+	}
+	if err := checkProfile(); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type PromptMode int
+
+const (
+	// Ask on the terminal
+	PromptInteractive PromptMode = iota
+
+	// Answer yes to everything
+	PromptYes
+
+	// Answer no to everything
+	PromptNo
+
+	// Take each prompt's default answer
+	PromptDefault
+)
+
+var errNoTTY = errors.New("stdin is not a terminal; rerun with --yes, --no or --assume-default")
+
+// Several options and no one to pick; callers say how to name one
+var errNoChoice = errors.New("several options and no way to ask")
+
+// Central place for every question apm asks
+type Prompter struct {
+	Mode PromptMode
+	In   *bufio.Reader
+	Out  io.Writer
+
+	// Nothing is written in a dry run, so confirmations need no answer
+	DryRun bool
+
+	// Overridable for non-file inputs
+	IsTerminal func() bool
+}
+
+var prompter = &Prompter{
+	Mode:       PromptInteractive,
+	In:         bufio.NewReader(os.Stdin),
+	Out:        os.Stdout,
+	IsTerminal: stdinIsTerminal,
+}
+
+// Prompt mode named in the config file
+func parsePromptSetting(value string) (PromptMode, error) {
+	switch value {
+	case "ask":
+		return PromptInteractive, nil
+	case "yes":
+		return PromptYes, nil
+	case "no":
+		return PromptNo, nil
+	case "default":
+		return PromptDefault, nil
+	}
+	return PromptInteractive, fmt.Errorf("expected ask, yes, no or default, got '%s'", value)
+}
+
+// Pick the prompt mode from the global flags
+func ParsePromptMode(yes, no, assumeDefault bool) (PromptMode, error) {
+	count := 0
+	for _, set := range []bool{yes, no, assumeDefault} {
+		if set {
+			count++
+		}
+	}
+	if count > 1 {
+		return PromptInteractive, fmt.Errorf("--yes, --no and --assume-default are mutually exclusive")
+	}
+	switch {
+	case yes:
+		return PromptYes, nil
+	case no:
+		return PromptNo, nil
+	case assumeDefault:
+		return PromptDefault, nil
+	}
+	return PromptInteractive, nil
+}
+
+func stdinIsTerminal() bool {
+	fi, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// Ask a yes/no question
+func (p *Prompter) Confirm(question string, def bool) (bool, error) {
+	hint := "[y/N]"
+	if def {
+		hint = "[Y/n]"
+	}
+	fmt.Fprintf(p.Out, "%s %s: ", question, hint)
+
+	switch p.Mode {
+	case PromptYes:
+		fmt.Fprintln(p.Out, "y (--yes)")
+		return true, nil
+	case PromptNo:
+		fmt.Fprintln(p.Out, "n (--no)")
+		return false, nil
+	case PromptDefault:
+		fmt.Fprintf(p.Out, "%s (--assume-default)\n", yesNo(def))
+		return def, nil
+	}
+	if p.DryRun {
+		fmt.Fprintln(p.Out, "y (--dry-run)")
+		return true, nil
+	}
+
+	for {
+		answer, err := p.readLine()
+		if err != nil {
+			return false, err
+		}
+		switch strings.ToLower(answer) {
+		case "":
+			return def, nil
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		}
+		fmt.Fprintf(p.Out, "Please answer y or n %s: ", hint)
+	}
+}
+
+// Ask for one of several options, returning its index. Without a
+// terminal to ask on only a single option can be taken; otherwise it
+// fails with errNoChoice, since guessing could edit the wrong thing.
+func (p *Prompter) Choose(question string, options []string) (int, error) {
+	fmt.Fprintln(p.Out, question)
+	for i, o := range options {
+		fmt.Fprintf(p.Out, "%d) %s\n", i+1, o)
+	}
+	fmt.Fprint(p.Out, "Select number: ")
+
+	if p.Mode != PromptInteractive {
+		if len(options) == 1 {
+			fmt.Fprintln(p.Out, "1 (non-interactive)")
+			return 0, nil
+		}
+		fmt.Fprintln(p.Out, "none (non-interactive)")
+		return -1, errNoChoice
+	}
+
+	for {
+		answer, err := p.readLine()
+		if errors.Is(err, errNoTTY) {
+			return -1, errNoChoice
+		}
+		if err != nil {
+			return -1, err
+		}
+		choice, err := strconv.Atoi(answer)
+		if err == nil && choice >= 1 && choice <= len(options) {
+			return choice - 1, nil
+		}
+		fmt.Fprintf(p.Out, "Enter a number between 1 and %d: ", len(options))
+	}
+}
+
+func (p *Prompter) readLine() (string, error) {
+	if p.IsTerminal != nil && !p.IsTerminal() {
+		fmt.Fprintln(p.Out)
+		return "", errNoTTY
+	}
+	line, err := p.In.ReadString('\n')
+	if err != nil {
+		fmt.Fprintln(p.Out)
+		if err == io.EOF {
+			return "", fmt.Errorf("no answer given (end of input)")
+		}
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "y"
+	}
+	return "n"
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestChoose(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     PromptMode
+		terminal bool
+		input    string
+		options  []string
+		want     int
+		err      error
+	}{
+		{"asks", PromptInteractive, true, "2\n", []string{"a", "b"}, 1, nil},
+		{"asks again", PromptInteractive, true, "7\n1\n", []string{"a", "b"}, 0, nil},
+		{"no terminal", PromptInteractive, false, "", []string{"a", "b"}, -1, errNoChoice},
+		{"yes takes a single option", PromptYes, false, "", []string{"a"}, 0, nil},
+		{"yes doesn't guess", PromptYes, false, "", []string{"a", "b"}, -1, errNoChoice},
+		{"default doesn't guess", PromptDefault, false, "", []string{"a", "b"}, -1, errNoChoice},
+		{"no", PromptNo, false, "", []string{"a", "b"}, -1, errNoChoice},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Prompter{
+				Mode:       tt.mode,
+				In:         bufio.NewReader(strings.NewReader(tt.input)),
+				Out:        io.Discard,
+				IsTerminal: func() bool { return tt.terminal },
+			}
+			got, err := p.Choose("which?", tt.options)
+			if got != tt.want || !errors.Is(err, tt.err) {
+				t.Errorf("Choose() = %d, %v; want %d, %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"alloylinux/apm/src/nix"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type RemoveStatus int
+
+const (
+	RemoveError RemoveStatus = iota
+	RemoveRemoved
+	RemoveNotPresent
+)
+
+var appIdPattern = regexp.MustCompile(`appId\s*=\s*"([^"]+)"`)
+
+// Remove package
+func removePackage(pkgName, flakeLocation string, method InstallationMethod) error {
+	pkgName = strings.TrimSpace(pkgName)
+	if pkgName == "" {
+		return fmt.Errorf("no package name given")
+	}
+
+	// Every entry that would go, e.g. both pkgs.git and unstable.git
+	entries, err := listBlockEntries(flakeLocation, method)
+	if err != nil {
+		return fmt.Errorf("error reading files: %v", err)
+	}
+	var found []BlockEntry
+	for _, e := range entries {
+		if entryMatches(e.Normalized(), pkgName, method) {
+			found = append(found, e)
+		}
+	}
+	if len(found) == 0 {
+		fmt.Printf("%s is not installed.\n", pkgName)
+		return nil
+	}
+
+	fmt.Printf("About to remove '%s' (%s):\n", pkgName, methodDisplayName(method))
+	for _, e := range found {
+		fmt.Printf("  - %s  (%s:%d)\n", e.Text, relToFlake(flakeLocation, e.File), e.Line)
+	}
+	if len(found) > 1 && method != Flatpak && !strings.Contains(pkgName, ".") {
+		fmt.Printf("Use pkgs.%s or unstable.%s to remove only one kind.\n", pkgName, pkgName)
+	}
+	ok, err := prompter.Confirm("Proceed?", false)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fmt.Println("Removal cancelled.")
+		return nil
+	}
+
+	files, err := packageFiles(flakeLocation)
+	if err != nil {
+		return fmt.Errorf("error reading files: %v", err)
+	}
+
+	block := blockNameForMethod(method)
+	removed := false
+	for _, f := range files {
+		res, err := removeFromNixBlock(f, block, pkgName, method)
+		if err != nil {
+			return err
+		}
+		switch res {
+		case RemoveRemoved:
+			fmt.Printf("Removed %s from %s\n", pkgName, f)
+			removed = true
+		case RemoveError:
+			// Only show real file errors
+			if _, err := changes.ReadFile(f); err != nil {
+				fmt.Printf("File error: %s\n", f)
+			}
+		}
+	}
+
+	if !removed {
+		fmt.Printf("No '%s' entry for %s found.\n", block, pkgName)
+	}
+	return nil
+}
+
+// Check if a block entry refers to the package
+func entryMatches(entry, pkgName string, method InstallationMethod) bool {
+	entry = strings.TrimSpace(entry)
+	if method == Flatpak {
+		if m := appIdPattern.FindStringSubmatch(entry); m != nil {
+			return m[1] == pkgName
+		}
+		return strings.Trim(entry, `"`) == pkgName
+	}
+	// A prefixed name only matches that exact entry
+	if strings.HasPrefix(pkgName, "pkgs.") || strings.HasPrefix(pkgName, "unstable.") {
+		return entry == pkgName
+	}
+	if entry == pkgName || entry == "pkgs."+pkgName || entry == "unstable."+pkgName {
+		return true
+	}
+	// Names like 3proxy are written quoted
+	quoted := attrPathExpr(pkgName)
+	return entry == "pkgs."+quoted || entry == "unstable."+quoted
+}
+
+// The error is only set when writing the file failed
+func removeFromNixBlock(file, blockName, pkgName string, method InstallationMethod) (RemoveStatus, error) {
+	parsed, err := parseNixFile(file)
+	if err != nil {
+		return RemoveError, nil
+	}
+	matches := packageLists(file, parsed, blockName)
+	if len(matches) == 0 {
+		return RemoveError, nil
+	}
+
+	rw := nix.NewRewriter(parsed)
+	for _, m := range matches {
+		scope := listScope(m)
+		for _, elem := range m.List.Elems {
+			text := normalizeEntry(strings.Join(strings.Fields(parsed.Text(elem)), " "), scope)
+			if entryMatches(text, pkgName, method) {
+				rw.RemoveListElem(elem)
+			}
+		}
+	}
+	if !rw.Changed() {
+		return RemoveNotPresent, nil
+	}
+
+	out, err := rw.Bytes()
+	if err != nil {
+		return RemoveError, fmt.Errorf("error editing %s: %v", file, err)
+	}
+	err = changes.WriteFile(file, out)
+	if err != nil {
+		return RemoveError, fmt.Errorf("error writing %s: %v", file, err)
+	}
+	return RemoveRemoved, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestEntryMatches(t *testing.T) {
+	tests := []struct {
+		entry  string
+		name   string
+		method InstallationMethod
+		want   bool
+	}{
+		{"pkgs.git", "git", HomeManager, true},
+		{"unstable.git", "git", HomeManager, true},
+		{"git", "git", HomeManager, true},
+		{"pkgs.gitFull", "git", HomeManager, false},
+		{"pkgs.kdePackages.kate", "kdePackages.kate", NixEnv, true},
+		{`pkgs."3proxy"`, "3proxy", NixEnv, true},
+		// A prefix picks one kind only
+		{"pkgs.git", "pkgs.git", HomeManager, true},
+		{"unstable.git", "pkgs.git", HomeManager, false},
+		{"pkgs.git", "unstable.git", HomeManager, false},
+		{"unstable.git", "unstable.git", HomeManager, true},
+		// Flatpaks by app id
+		{`{ appId = "org.gnome.Evince"; origin = "flathub"; }`, "org.gnome.Evince", Flatpak, true},
+		{`{ appId = "org.gnome.Evince"; origin = "flathub"; }`, "org.gnome.Evolution", Flatpak, false},
+		{`"org.gnome.Evince"`, "org.gnome.Evince", Flatpak, true},
+	}
+	for _, tt := range tests {
+		if got := entryMatches(tt.entry, tt.name, tt.method); got != tt.want {
+			t.Errorf("entryMatches(%q, %q, %v) = %v, want %v", tt.entry, tt.name, tt.method, got, tt.want)
+		}
+	}
+}
+
+// Bare names in a `with pkgs;` list are matched once normalized
+func TestEntryMatchesWithScope(t *testing.T) {
+	for _, name := range []string{"git", "pkgs.git"} {
+		if !entryMatches(normalizeEntry("git", "pkgs"), name, NixEnv) {
+			t.Errorf("bare git in `with pkgs;` should match %q", name)
+		}
+	}
+	if entryMatches(normalizeEntry("git", "pkgs"), "unstable.git", NixEnv) {
+		t.Error("bare git in `with pkgs;` should not match unstable.git")
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	TxOpen       = "open"
+	TxCommitted  = "committed"
+	TxRolledBack = "rolled-back"
+)
+
+// File changes made by one command, with snapshots of the originals
+type Transaction struct {
+	ID          string    `json:"id"`
+	Description string    `json:"description"`
+	Time        time.Time `json:"time"`
+	Status      string    `json:"status"`
+	Files       []TxFile  `json:"files"`
+	// Directories the transaction created
+	Dirs []string `json:"dirs,omitempty"`
+
+	dir string
+}
+
+type TxFile struct {
+	Path    string `json:"path"`
+	Existed bool   `json:"existed"`
+	// Snapshot of the original, relative to the transaction directory
+	Backup string `json:"backup,omitempty"`
+	// Hash of the content the transaction left behind
+	After string `json:"after,omitempty"`
+}
+
+// Directory holding one subdirectory per transaction
+func backupsDir() (string, error) {
+	homedir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homedir, ".cache", "apm", "backups"), nil
+}
+
+// Run fn as one transaction, undoing its file changes if it fails
+func runTx(description string, fn func() error) error {
+	var repo *gitRepo
+	if flakeDir, err := configuredFlakeDir(); err == nil {
+		repo = findGitRepo(flakeDir)
+	}
+	if repo != nil {
+		if err := gitPreflight(repo); err != nil {
+			return err
+		}
+	}
+
+	changes.Begin(description)
+	if err := fn(); err != nil {
+		if rbErr := changes.Rollback(); rbErr != nil {
+			return fmt.Errorf("%v (rollback failed: %v)", err, rbErr)
+		}
+		return err
+	}
+	tx, err := changes.Commit()
+	if err != nil {
+		return err
+	}
+	if repo != nil && tx != nil {
+		gitRecord(repo, tx)
+	}
+	return nil
+}
+
+// Start grouping file changes; the snapshot directory is made on first write
+func (c *ChangeSet) Begin(description string) {
+	c.tx = &Transaction{Description: description, Time: time.Now(), Status: TxOpen}
+}
+
+// Snapshot a file before its first change
+func (c *ChangeSet) snapshot(path string, old []byte) error {
+	if c.tx == nil || c.DryRun {
+		return nil
+	}
+	if c.tx.dir == "" {
+		if err := c.tx.create(); err != nil {
+			return fmt.Errorf("error creating backup: %v", err)
+		}
+	}
+	file := TxFile{Path: path, Existed: old != nil}
+	if old != nil {
+		file.Backup = strconv.Itoa(len(c.tx.Files))
+		if err := os.WriteFile(filepath.Join(c.tx.dir, file.Backup), old, 0644); err != nil {
+			return fmt.Errorf("error backing up %s: %v", path, err)
+		}
+	}
+	c.tx.Files = append(c.tx.Files, file)
+	return c.tx.save()
+}
+
+// Remember directories that MkdirAll is about to create
+func (c *ChangeSet) recordDirs(path string) error {
+	if c.tx == nil || c.DryRun {
+		return nil
+	}
+	var created []string
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(dir); err == nil || dir == filepath.Dir(dir) {
+			break
+		}
+		created = append(created, dir)
+	}
+	if len(created) == 0 {
+		return nil
+	}
+	if c.tx.dir == "" {
+		if err := c.tx.create(); err != nil {
+			return fmt.Errorf("error creating backup: %v", err)
+		}
+	}
+	c.tx.Dirs = append(c.tx.Dirs, created...)
+	return c.tx.save()
+}
+
+// Finish the transaction, keeping its snapshots for restore.
+// Returns nil when nothing was written.
+func (c *ChangeSet) Commit() (*Transaction, error) {
+	tx := c.tx
+	c.reset()
+	if tx == nil || tx.dir == "" {
+		return nil, nil
+	}
+	for i := range tx.Files {
+		tx.Files[i].After = hashFile(tx.Files[i].Path)
+	}
+	tx.Status = TxCommitted
+	if err := tx.save(); err != nil {
+		return nil, err
+	}
+	fmt.Printf("Saved as transaction %s (undo with 'apm restore %s')\n", tx.ID, tx.ID)
+	return tx, nil
+}
+
+// Put every file the transaction touched back the way it was
+func (c *ChangeSet) Rollback() error {
+	tx := c.tx
+	if c.DryRun {
+		// Nothing to undo, only drop the half-done changes from the report
+		c.pending = map[string][]byte{}
+		c.removed = map[string]bool{}
+		c.originals = map[string][]byte{}
+		c.order = nil
+	}
+	c.reset()
+	if tx == nil || tx.dir == "" {
+		return nil
+	}
+	var errs []error
+	for i := len(tx.Files) - 1; i >= 0; i-- {
+		if err := tx.restoreFile(tx.Files[i], os.WriteFile, os.Remove); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, dir := range tx.Dirs {
+		// Only empty directories go, anything else was not ours alone
+		os.Remove(dir)
+	}
+	tx.Status = TxRolledBack
+	if err := tx.save(); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	fmt.Printf("Rolled back changes to %d file(s)\n", len(tx.Files))
+	return nil
+}
+
+// Forget the transaction; a dry run keeps its changes for the report
+func (c *ChangeSet) reset() {
+	c.tx = nil
+	if !c.DryRun {
+		c.originals = map[string][]byte{}
+		c.order = nil
+	}
+}
+
+// Bring one file back to its snapshot
+func (tx *Transaction) restoreFile(f TxFile, write func(string, []byte, os.FileMode) error, remove func(string) error) error {
+	if !f.Existed {
+		if err := remove(f.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := os.ReadFile(filepath.Join(tx.dir, f.Backup))
+	if err != nil {
+		return fmt.Errorf("missing backup of %s: %v", f.Path, err)
+	}
+	return write(f.Path, data, 0644)
+}
+
+// Pick a free id and make the transaction's directory
+func (tx *Transaction) create() error {
+	root, err := backupsDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return err
+	}
+	base := tx.Time.Format("20060102-150405")
+	for n := 1; ; n++ {
+		id := base
+		if n > 1 {
+			id = fmt.Sprintf("%s-%d", base, n)
+		}
+		dir := filepath.Join(root, id)
+		err := os.Mkdir(dir, 0o755)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		tx.ID, tx.dir = id, dir
+		return nil
+	}
+}
+
+func (tx *Transaction) save() error {
+	data, err := json.MarshalIndent(tx, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(tx.dir, "manifest.json"), data, 0644)
+}
+
+// Load a past transaction by id
+func loadTransaction(id string) (*Transaction, error) {
+	root, err := backupsDir()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(root, filepath.Base(id))
+	data, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no transaction %s", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tx Transaction
+	if err := json.Unmarshal(data, &tx); err != nil {
+		return nil, fmt.Errorf("bad manifest for %s: %v", id, err)
+	}
+	tx.dir = dir
+	return &tx, nil
+}
+
+// Past transactions, newest first
+func listTransactions() ([]*Transaction, error) {
+	root, err := backupsDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var txs []*Transaction
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		tx, err := loadTransaction(e.Name())
+		if err != nil {
+			continue
+		}
+		txs = append(txs, tx)
+	}
+	sort.Slice(txs, func(i, j int) bool { return txs[i].Time.After(txs[j].Time) })
+	return txs, nil
+}
+
+// Revert the files of a past transaction, itself as a new transaction
+func restoreTransaction(id string) error {
+	tx, err := loadTransaction(id)
+	if err != nil {
+		return err
+	}
+	if tx.Status == TxRolledBack {
+		return fmt.Errorf("transaction %s was already rolled back", tx.ID)
+	}
+
+	fmt.Printf("About to restore %d file(s) changed by '%s' (%s):\n", len(tx.Files), tx.Description, tx.Time.Format("2006-01-02 15:04:05"))
+	edited := false
+	for _, f := range tx.Files {
+		note := ""
+		if tx.Status == TxCommitted && hashFile(f.Path) != f.After {
+			note = " (changed since, later edits will be lost)"
+			edited = true
+		}
+		if f.Existed {
+			fmt.Printf("  ~ %s%s\n", f.Path, note)
+		} else {
+			fmt.Printf("  - %s%s\n", f.Path, note)
+		}
+	}
+	ok, err := prompter.Confirm("Proceed?", !edited)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fmt.Println("Restore cancelled.")
+		return nil
+	}
+
+	return runTx("restore "+tx.ID, func() error {
+		for i := len(tx.Files) - 1; i >= 0; i-- {
+			write := func(path string, data []byte, _ os.FileMode) error { return changes.WriteFile(path, data) }
+			if err := tx.restoreFile(tx.Files[i], write, changes.Remove); err != nil {
+				return err
+			}
+		}
+		if !changes.DryRun {
+			for _, dir := range tx.Dirs {
+				// Only removed once empty again
+				os.Remove(dir)
+			}
+		}
+		fmt.Printf("Restored %s\n", tx.ID)
+		return nil
+	})
+}
+
+// sha256 of a file, empty when it does not exist
+func hashFile(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
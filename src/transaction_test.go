@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Run with a temporary home, no flake and fresh global state, answering
+// yes to every prompt
+func testEnv(t *testing.T) string {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("APM_PROFILE", "")
+
+	oldSettings, oldChanges, oldPrompter := settings, changes, prompter
+	oldProfile, oldHost := activeProfile, activeHost
+	t.Cleanup(func() {
+		settings, changes, prompter = oldSettings, oldChanges, oldPrompter
+		activeProfile, activeHost = oldProfile, oldHost
+	})
+	settings = &Config{}
+	changes = newChangeSet()
+	prompter = &Prompter{Mode: PromptYes, In: bufio.NewReader(strings.NewReader("")), Out: io.Discard}
+	activeProfile, activeHost = "", ""
+	return home
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Content of a file, or "<missing>"
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "<missing>"
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRollback(t *testing.T) {
+	testEnv(t)
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "flake.nix")
+	writeTestFile(t, existing, "old")
+	newDir := filepath.Join(dir, "packages", "extra")
+	created := filepath.Join(newDir, "home-packages.nix")
+
+	failure := errors.New("step failed")
+	err := runTx("test", func() error {
+		if err := changes.WriteFile(existing, []byte("new")); err != nil {
+			return err
+		}
+		if err := changes.MkdirAll(newDir); err != nil {
+			return err
+		}
+		if err := changes.WriteFile(created, []byte("created")); err != nil {
+			return err
+		}
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("runTx returned %v, want the step's error", err)
+	}
+	if got := readTestFile(t, existing); got != "old" {
+		t.Errorf("flake.nix is %q after rollback, want the original", got)
+	}
+	if got := readTestFile(t, created); got != "<missing>" {
+		t.Errorf("created file still exists after rollback: %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "packages")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("created directories still exist after rollback: %v", err)
+	}
+
+	txs, err := listTransactions()
+	if err != nil || len(txs) != 1 || txs[0].Status != TxRolledBack {
+		t.Errorf("want one rolled back transaction, got %v, %v", txs, err)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	testEnv(t)
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "flake.nix")
+	writeTestFile(t, existing, "old")
+	created := filepath.Join(dir, "home-packages.nix")
+
+	err := runTx("test", func() error {
+		if err := changes.WriteFile(existing, []byte("new")); err != nil {
+			return err
+		}
+		return changes.WriteFile(created, []byte("created"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, existing); got != "new" {
+		t.Fatalf("flake.nix is %q after commit", got)
+	}
+	txs, err := listTransactions()
+	if err != nil || len(txs) != 1 || txs[0].Status != TxCommitted {
+		t.Fatalf("want one committed transaction, got %v, %v", txs, err)
+	}
+
+	if err := restoreTransaction(txs[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, existing); got != "old" {
+		t.Errorf("flake.nix is %q after restore, want the original", got)
+	}
+	if got := readTestFile(t, created); got != "<missing>" {
+		t.Errorf("created file still exists after restore: %q", got)
+	}
+
+	// The restore is a transaction of its own, so it can be undone too
+	txs, err = listTransactions()
+	if err != nil || len(txs) != 2 {
+		t.Fatalf("want two transactions, got %v, %v", txs, err)
+	}
+}
@@ -2,17 +2,44 @@ package main
 
 import "fmt"
 
-// Parse method string
+// Every installation method
+var installationMethods = []InstallationMethod{NixEnv, HomeManager, Flatpak}
+
+// Parse method string, a flag name such as home-manager
 func ParseMethod(s string) (InstallationMethod, error) {
-	switch s {
-	case "nix-env":
-		return NixEnv, nil
-	case "flatpak":
-		return Flatpak, nil
-	case "home-manager":
-		return HomeManager, nil
+	for _, method := range installationMethods {
+		if methodFlagName(method) == s {
+			return method, nil
+		}
+	}
+	return -1, fmt.Errorf("invalid method '%s' (expected nix-env, home-manager or flatpak)", s)
+}
+
+// Method as its flag name, the inverse of ParseMethod
+func methodFlagName(method InstallationMethod) string {
+	switch method {
+	case NixEnv:
+		return "nix-env"
+	case Flatpak:
+		return "flatpak"
+	case HomeManager:
+		return "home-manager"
 	default:
-		return -1, fmt.Errorf("invalid method")
+		return "unknown"
+	}
+}
+
+// Method name for messages
+func methodDisplayName(method InstallationMethod) string {
+	switch method {
+	case NixEnv:
+		return "NixEnv"
+	case Flatpak:
+		return "Flatpak"
+	case HomeManager:
+		return "HomeManager"
+	default:
+		return "Unknown"
 	}
 }
 
@@ -37,5 +64,8 @@ func DetermineMethod(flatpak, nixEnv, homeManager bool) (InstallationMethod, err
 	if nixEnv {
 		return NixEnv, nil
 	}
-	return HomeManager, nil
+	if homeManager {
+		return HomeManager, nil
+	}
+	return defaultMethod(), nil
 }